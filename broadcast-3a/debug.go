@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+type DebugStateMessage struct {
+	Type string `json:"type"`
+}
+
+type DebugStateMessageResponse struct {
+	Type     string `json:"type"`
+	NodeID   string `json:"node_id"`
+	Role     string `json:"role"`
+	SetSize  int    `json:"set_size"`
+	UptimeMs int64  `json:"uptime_ms"`
+}
+
+func (s *Server) debugStateHandler(msg maelstrom.Message) error {
+	var body DebugStateMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	debugStateMessageResponse := DebugStateMessageResponse{
+		Type:     "debug_state_ok",
+		NodeID:   s.nodeID,
+		Role:     "SINGLE",
+		SetSize:  s.messages.Count(),
+		UptimeMs: time.Since(s.startedAt).Milliseconds(),
+	}
+
+	return s.node.Reply(msg, debugStateMessageResponse)
+}
@@ -4,16 +4,19 @@ import (
 	"encoding/json"
 	"log"
 	"sync"
+	"time"
 
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/valueset"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
 type Server struct {
-	node   *maelstrom.Node
-	nodeID string
+	node      *maelstrom.Node
+	nodeID    string
+	startedAt time.Time
 
 	mu       sync.Mutex
-	messages map[int]struct{}
+	messages valueset.Set
 }
 
 type BroadcastMessage struct {
@@ -43,13 +46,14 @@ type ReadMessageResponse struct {
 	Messages []int  `json:"messages"`
 }
 
-func NewServer(n *maelstrom.Node) *Server {
-	s := &Server{node: n, messages: make(map[int]struct{})}
+func NewServer(n *maelstrom.Node, messages valueset.Set) *Server {
+	s := &Server{node: n, startedAt: time.Now(), messages: messages}
 
 	s.node.Handle("init", s.initHandler)
 	s.node.Handle("broadcast", s.broadcastHandler)
 	s.node.Handle("read", s.readHandler)
 	s.node.Handle("topology", s.topologyHandler)
+	s.node.Handle("debug_state", s.debugStateHandler)
 
 	return s
 }
@@ -57,7 +61,7 @@ func NewServer(n *maelstrom.Node) *Server {
 func (s *Server) initHandler(msg maelstrom.Message) error {
 	var body maelstrom.InitMessageBody
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	s.nodeID = body.NodeID
@@ -70,13 +74,13 @@ func (s *Server) initHandler(msg maelstrom.Message) error {
 func (s *Server) broadcastHandler(msg maelstrom.Message) error {
 	var body BroadcastMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.messages[body.Message] = struct{}{}
+	s.messages.Add(body.Message)
 
 	broadcastMessageResponse := BroadcastMessageResponse{
 		Type: "broadcast_ok",
@@ -88,20 +92,15 @@ func (s *Server) broadcastHandler(msg maelstrom.Message) error {
 func (s *Server) readHandler(msg maelstrom.Message) error {
 	var body ReadMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	messages := make([]int, 0, len(s.messages))
-	for m := range s.messages {
-		messages = append(messages, m)
-	}
-
 	readMessageResponse := ReadMessageResponse{
 		Type:     "read_ok",
-		Messages: messages,
+		Messages: valueset.Values(s.messages),
 	}
 
 	return s.node.Reply(msg, readMessageResponse)
@@ -110,7 +109,7 @@ func (s *Server) readHandler(msg maelstrom.Message) error {
 func (s *Server) topologyHandler(msg maelstrom.Message) error {
 	var body TopologyMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	// We ignore topology sent from maelstrom's controller, at least for now
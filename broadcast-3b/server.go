@@ -4,17 +4,20 @@ import (
 	"encoding/json"
 	"log"
 	"sync"
+	"time"
 
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/valueset"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
 type Server struct {
-	node   *maelstrom.Node
-	nodeID string
-	peers  []string
+	node      *maelstrom.Node
+	nodeID    string
+	startedAt time.Time
+	peers     []string
 
 	mu       sync.Mutex
-	messages map[int]struct{}
+	messages valueset.Set
 }
 
 type BroadcastMessage struct {
@@ -44,13 +47,14 @@ type ReadMessageResponse struct {
 	Messages []int  `json:"messages"`
 }
 
-func NewServer(n *maelstrom.Node) *Server {
-	s := &Server{node: n, messages: make(map[int]struct{})}
+func NewServer(n *maelstrom.Node, messages valueset.Set) *Server {
+	s := &Server{node: n, startedAt: time.Now(), messages: messages}
 
 	s.node.Handle("init", s.initHandler)
 	s.node.Handle("broadcast", s.broadcastHandler)
 	s.node.Handle("read", s.readHandler)
 	s.node.Handle("topology", s.topologyHandler)
+	s.node.Handle("debug_state", s.debugStateHandler)
 
 	// no-op handlers
 	s.node.Handle("broadcast_ok", s.noOpHandler)
@@ -64,7 +68,7 @@ func (s *Server) initHandler(msg maelstrom.Message) error {
 
 	var body maelstrom.InitMessageBody
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	s.nodeID = body.NodeID
@@ -89,11 +93,11 @@ func (s *Server) broadcastHandler(msg maelstrom.Message) error {
 
 	var body BroadcastMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	// To avoid cycles: n0->n1->n2->n0
-	if _, exists := s.messages[body.Message]; exists {
+	if s.messages.Contains(body.Message) {
 		broadcastMessageResponse := BroadcastMessageResponse{
 			Type: "broadcast_ok",
 		}
@@ -101,7 +105,7 @@ func (s *Server) broadcastHandler(msg maelstrom.Message) error {
 		return s.node.Reply(msg, broadcastMessageResponse)
 	}
 
-	s.messages[body.Message] = struct{}{}
+	s.messages.Add(body.Message)
 
 	// To avoid: n0->n0
 	for _, peerID := range s.peers {
@@ -126,20 +130,15 @@ func (s *Server) noOpHandler(maelstrom.Message) error {
 func (s *Server) readHandler(msg maelstrom.Message) error {
 	var body ReadMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	messages := make([]int, 0, len(s.messages))
-	for m := range s.messages {
-		messages = append(messages, m)
-	}
-
 	readMessageResponse := ReadMessageResponse{
 		Type:     "read_ok",
-		Messages: messages,
+		Messages: valueset.Values(s.messages),
 	}
 
 	return s.node.Reply(msg, readMessageResponse)
@@ -148,16 +147,25 @@ func (s *Server) readHandler(msg maelstrom.Message) error {
 func (s *Server) topologyHandler(msg maelstrom.Message) error {
 	var body TopologyMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
-	// We ignore topology sent from maelstrom's controller, at least for now
 	topologyMessageResponse := TopologyMessageResponse{
 		Type: "topology_ok",
 	}
 
 	log.Printf("Received topology information from controller: %v", body.Topology)
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Until the first topology arrives we flood to the whole cluster, a topology
+	// that does not mention us leaves the neighbors as they are
+	if neighbors, ok := body.Topology[s.nodeID]; ok {
+		s.peers = neighbors
+		log.Printf("Using neighbors: %v", s.peers)
+	}
+
 	return s.node.Reply(msg, topologyMessageResponse)
 }
 
@@ -4,15 +4,56 @@ import (
 	"log"
 	"os"
 
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/config"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/history"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/replay"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/unsupported"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/valueset"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
 func main() {
 	log.SetOutput(os.Stderr)
 
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	messages, err := valueset.New(cfg.Broadcast.MessageStore)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Only broadcast-3e persists its state, the value set here lives in memory
+	if cfg.DataDir != "" {
+		log.Printf("DATA_DIR is not supported by this node, ignoring %s", cfg.DataDir)
+	}
+
 	n := maelstrom.NewNode()
 
-	s := NewServer(n)
+	// Answer the requests of other workloads instead of dying on them
+	unsupported.Attach(n, "broadcast", "read", "topology")
+
+	// Record client operations for offline checking
+	if cfg.HistoryDir != "" {
+		recorder, err := history.Attach(n, cfg.HistoryDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer recorder.Close()
+	}
+
+	// Keep every inbound message so a failed run can be replayed on a single node
+	if cfg.RecordDir != "" {
+		recorder, err := replay.Attach(n, cfg.RecordDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer recorder.Close()
+	}
+
+	s := NewServer(n, messages, cfg)
 
 	if err := s.Run(); err != nil {
 		log.Fatal(err)
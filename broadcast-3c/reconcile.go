@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/valueset"
+)
+
+// Anti-entropy with a random alive member every interval, over Merkle trees
+// (pkg/merkle) or IBLT sketches (pkg/sketch) of the value set. Only the
+// handlers of the configured protocol are registered, peers asking for the
+// other one get not-supported.
+
+// reconciler runs one round of anti-entropy with a peer
+type reconciler interface {
+	Reconcile(peerID string) error
+}
+
+// reconciledSet is the value set as the reconcilers see it. What they recover
+// goes through addValue, so the tree or table stay in sync with the set.
+type reconciledSet struct {
+	valueset.Set
+	s *Server
+}
+
+func (r reconciledSet) Add(v int) bool {
+	return r.s.addValue(v)
+}
+
+func (s *Server) reconcile() {
+	for range s.reconcileTicker.C {
+		peers := s.detector.AliveMembers()
+		if len(peers) == 0 {
+			continue
+		}
+
+		peerID := peers[rand.Intn(len(peers))]
+		if err := s.reconciler.Reconcile(peerID); err != nil {
+			log.Printf("Failed to reconcile with node %s: %v", peerID, err)
+		}
+	}
+}
@@ -3,25 +3,42 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
-	"math/rand"
 	"sync"
 	"time"
 
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/config"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/membership"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/merkle"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/retry"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/sketch"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/valueset"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
 type Server struct {
-	node   *maelstrom.Node
-	nodeID string
+	node      *maelstrom.Node
+	nodeID    string
+	startedAt time.Time
+	cfg       config.Config
 
 	mu       sync.Mutex
-	messages map[int]struct{}
+	messages valueset.Set
 
 	topology   map[string][]string
 	masterNode string
 
 	role string
+
+	detector *membership.Detector
+	retrier  *retry.Retrier
+
+	// Only the ones for the configured reconciliation are set, none without
+	tree            *merkle.Tree
+	table           *sketch.IBLT
+	reconciler      reconciler
+	reconcileTicker *time.Ticker
 }
 
 type BroadcastMessage struct {
@@ -34,8 +51,9 @@ type BroadcastMessageResponse struct {
 }
 
 type BroadcastInternalMessage struct {
-	Type    string `json:"type"`
-	Message int    `json:"message"`
+	Type    string              `json:"type"`
+	Message int                 `json:"message"`
+	Members []membership.Update `json:"members,omitempty"`
 }
 
 type BroadcastInternalMessageResponse struct {
@@ -60,14 +78,34 @@ type ReadMessageResponse struct {
 	Messages []int  `json:"messages"`
 }
 
-func NewServer(n *maelstrom.Node) *Server {
-	s := &Server{node: n, messages: make(map[int]struct{})}
+func NewServer(n *maelstrom.Node, messages valueset.Set, cfg config.Config) *Server {
+	d := membership.NewDetector(n, cfg.Membership.ProbeInterval.Duration(), cfg.Membership.SuspicionTimeout.Duration())
+	s := &Server{node: n, startedAt: time.Now(), cfg: cfg, messages: messages, detector: d, retrier: retry.New(cfg.Retry.Policy())}
+
+	switch cfg.Broadcast.Reconciliation {
+	case "merkle":
+		s.tree = merkle.New()
+		r := merkle.NewReconciler(n, cfg.RPC.Timeout.Duration(), &s.mu, s.tree, reconciledSet{messages, s})
+		s.node.Handle("merkle", r.TreeHandler)
+		s.node.Handle("merkle_leaves", r.LeavesHandler)
+		s.reconciler = r
+	case "iblt":
+		s.table = sketch.NewIBLT()
+		r := sketch.NewReconciler(n, cfg.RPC.Timeout.Duration(), &s.mu, s.table, reconciledSet{messages, s})
+		s.node.Handle("iblt", r.IBLTHandler)
+		s.node.Handle("bloom", r.BloomHandler)
+		s.reconciler = r
+	}
+	if s.reconciler != nil {
+		s.reconcileTicker = time.NewTicker(cfg.Broadcast.AntiEntropyInterval.Duration())
+	}
 
 	s.node.Handle("init", s.initHandler)
 	s.node.Handle("broadcast", s.broadcastHandler)
 	s.node.Handle("broadcast_internal", s.broadcastInternalHandler)
 	s.node.Handle("read", s.readHandler)
 	s.node.Handle("topology", s.topologyHandler)
+	s.node.Handle("debug_state", s.debugStateHandler)
 
 	// no-op handlers
 	s.node.Handle("broadcast_ok", s.noOpHandler)
@@ -82,12 +120,14 @@ func (s *Server) initHandler(msg maelstrom.Message) error {
 
 	var body maelstrom.InitMessageBody
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	s.nodeID = body.NodeID
 	log.Printf("Node id set to: %s", s.nodeID)
 
+	s.detector.Init(body.NodeID, body.NodeIDs)
+
 	return nil
 }
 
@@ -97,11 +137,11 @@ func (s *Server) broadcastHandler(msg maelstrom.Message) error {
 
 	var body BroadcastMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	// To avoid cycles: n0->n1->n2->n0
-	if _, exists := s.messages[body.Message]; exists {
+	if s.messages.Contains(body.Message) {
 		broadcastMessageResponse := BroadcastMessageResponse{
 			Type: "broadcast_ok",
 		}
@@ -109,20 +149,28 @@ func (s *Server) broadcastHandler(msg maelstrom.Message) error {
 		return s.node.Reply(msg, broadcastMessageResponse)
 	}
 
-	s.messages[body.Message] = struct{}{}
+	s.addValue(body.Message)
 
 	broadcastInternalMessage := BroadcastInternalMessage{
 		Type:    "broadcast_internal",
 		Message: body.Message,
+		Members: s.detector.Piggyback(),
 	}
 
 	for _, peerID := range s.topology[s.nodeID] {
-		go broadcastMessageToPeer(s.node, peerID, broadcastInternalMessage)
+		go s.broadcastMessageToPeer(peerID, broadcastInternalMessage)
 	}
 
 	if s.role == "FOLLOWER" {
-		// Broadcast to the master node
-		go broadcastMessageToPeer(s.node, s.masterNode, broadcastInternalMessage)
+		if s.detector.Alive(s.masterNode) {
+			// Broadcast to the master node
+			go s.broadcastMessageToPeer(s.masterNode, broadcastInternalMessage)
+		} else {
+			// The tree is cut without its root, reach everybody directly instead
+			for _, peerID := range s.detector.AliveMembers() {
+				go s.broadcastMessageToPeer(peerID, broadcastInternalMessage)
+			}
+		}
 	}
 
 	broadcastMessageResponse := BroadcastMessageResponse{
@@ -138,11 +186,13 @@ func (s *Server) broadcastInternalHandler(msg maelstrom.Message) error {
 
 	var body BroadcastInternalMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
+	s.detector.Merge(body.Members)
+
 	// To avoid cycles: n0->n1->n2->n0
-	if _, exists := s.messages[body.Message]; exists {
+	if s.messages.Contains(body.Message) {
 		broadcastInternalMessageResponse := BroadcastInternalMessageResponse{
 			Type: "broadcast_internal_ok",
 		}
@@ -150,11 +200,13 @@ func (s *Server) broadcastInternalHandler(msg maelstrom.Message) error {
 		return s.node.Reply(msg, broadcastInternalMessageResponse)
 	}
 
-	s.messages[body.Message] = struct{}{}
+	s.addValue(body.Message)
+
+	body.Members = s.detector.Piggyback()
 
 	// To avoid: n0->n0
 	for _, peerID := range s.topology[s.nodeID] {
-		go broadcastMessageToPeer(s.node, peerID, body)
+		go s.broadcastMessageToPeer(peerID, body)
 	}
 
 	broadcastInternalMessageResponse := BroadcastInternalMessageResponse{
@@ -164,21 +216,46 @@ func (s *Server) broadcastInternalHandler(msg maelstrom.Message) error {
 	return s.node.Reply(msg, broadcastInternalMessageResponse)
 }
 
-func broadcastMessageToPeer(node *maelstrom.Node, peerID string, body BroadcastInternalMessage) {
-	backoff := time.Millisecond
-	for {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		_, err := node.SyncRPC(ctx, peerID, body)
-		cancel()
+// addValue stores a value, and indexes it for reconciliation. Must be called
+// with s.mu held.
+func (s *Server) addValue(v int) bool {
+	if !s.messages.Add(v) {
+		return false
+	}
 
-		if err == nil {
-			return
-		}
+	if s.tree != nil {
+		s.tree.Add(v)
+	}
+	if s.table != nil {
+		s.table.Insert(v)
+	}
+
+	return true
+}
 
-		time.Sleep(backoff + time.Duration(rand.Intn(50))*time.Millisecond)
-		if backoff < 500*time.Millisecond {
-			backoff *= 2
+func (s *Server) broadcastMessageToPeer(peerID string, body BroadcastInternalMessage) {
+	err := s.retrier.Do(context.Background(), peerID, func(ctx context.Context) error {
+		// No point in hammering a peer the failure detector considers dead. The
+		// wait is bounded like a call, so it counts against the retry limits.
+		waitCtx, stopWaiting := context.WithTimeout(ctx, s.cfg.RPC.Timeout.Duration())
+		alive, waitErr := s.detector.WaitAlive(waitCtx, peerID)
+		stopWaiting()
+		if waitErr != nil {
+			return fmt.Errorf("node %s is down: %w", peerID, waitErr)
+		}
+		if !alive {
+			return retry.Permanent(fmt.Errorf("node %s left the cluster", peerID))
 		}
+
+		ctx, cancel := context.WithTimeout(ctx, s.cfg.RPC.Timeout.Duration())
+		defer cancel()
+
+		_, err := s.node.SyncRPC(ctx, peerID, body)
+		return err
+	})
+
+	if err != nil {
+		log.Printf("Giving up on forwarding to node %s: %v", peerID, err)
 	}
 }
 
@@ -189,20 +266,15 @@ func (s *Server) noOpHandler(maelstrom.Message) error {
 func (s *Server) readHandler(msg maelstrom.Message) error {
 	var body ReadMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	messages := make([]int, 0, len(s.messages))
-	for m := range s.messages {
-		messages = append(messages, m)
-	}
-
 	readMessageResponse := ReadMessageResponse{
 		Type:     "read_ok",
-		Messages: messages,
+		Messages: valueset.Values(s.messages),
 	}
 
 	return s.node.Reply(msg, readMessageResponse)
@@ -214,22 +286,23 @@ func (s *Server) topologyHandler(msg maelstrom.Message) error {
 
 	var body TopologyMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
-	// We ignore topology sent from maelstrom's controller, at least for now
 	topologyMessageResponse := TopologyMessageResponse{
 		Type: "topology_ok",
 	}
 
 	log.Printf("Received topology information from controller: %v", body.Topology)
 
-	s.topology = topology
-	s.masterNode = masterNode
+	// May arrive at any time, forwards already in flight to peers that are no
+	// longer our children keep retrying, the values were accepted before the swap
+	s.masterNode = treeRoot(body.Topology, s.cfg.Broadcast.MasterNode)
+	s.topology = rootedAt(body.Topology, s.masterNode)
 
 	log.Printf("Using topology: %v, central node: %s", s.topology, s.masterNode)
 
-	if s.nodeID == masterNode {
+	if s.nodeID == s.masterNode {
 		s.role = "LEADER"
 	} else {
 		s.role = "FOLLOWER"
@@ -239,5 +312,11 @@ func (s *Server) topologyHandler(msg maelstrom.Message) error {
 }
 
 func (s *Server) Run() error {
+	go s.detector.Run()
+
+	if s.reconcileTicker != nil {
+		go s.reconcile()
+	}
+
 	return s.node.Run()
 }
@@ -1,32 +1,69 @@
 package main
 
-var topology = map[string][]string{
-	"n0":  {},
-	"n1":  {"n0"},
-	"n2":  {"n1", "n3"},
-	"n3":  {"n4"},
-	"n4":  {},
-	"n5":  {},
-	"n6":  {"n5"},
-	"n7":  {"n6", "n2", "n8"},
-	"n8":  {"n9"},
-	"n9":  {},
-	"n10": {},
-	"n11": {"n10"},
-	"n12": {"n7", "n11", "n13", "n17"},
-	"n13": {"n14"},
-	"n14": {},
-	"n15": {},
-	"n16": {"n15"},
-	"n17": {"n16", "n18", "n22"},
-	"n18": {"n19"},
-	"n19": {},
-	"n20": {},
-	"n21": {"n20"},
-	"n22": {"n21", "n23"},
-	"n23": {"n24"},
-	"n24": {},
+import "slices"
+
+// treeRoot is the preferred master if it is part of the topology, otherwise the
+// lowest node ID, so that every node picks the same one
+func treeRoot(topology map[string][]string, preferred string) string {
+	if _, ok := topology[preferred]; ok || len(topology) == 0 {
+		return preferred
+	}
+
+	nodeIDs := make([]string, 0, len(topology))
+	for nodeID := range topology {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	slices.Sort(nodeIDs)
+
+	return nodeIDs[0]
 }
 
-// It is hardcoded, in a real system it should be dynamic
-var masterNode = "n12"
+// rootedAt turns the controller's topology into a spanning tree with every edge
+// pointing away from root, found breadth first so the tree is as shallow as the
+// topology allows. Edges are used in both directions. An unknown root leaves the
+// topology as it is.
+func rootedAt(topology map[string][]string, root string) map[string][]string {
+	if _, ok := topology[root]; !ok {
+		return topology
+	}
+
+	edges := make(map[string][]string)
+	for parent, children := range topology {
+		for _, child := range children {
+			edges[parent] = append(edges[parent], child)
+			edges[child] = append(edges[child], parent)
+		}
+	}
+
+	rooted := map[string][]string{root: {}}
+	queue := []string{root}
+	for len(queue) > 0 {
+		nodeID := queue[0]
+		queue = queue[1:]
+
+		next := edges[nodeID]
+		slices.Sort(next)
+		for _, peerID := range next {
+			if _, seen := rooted[peerID]; seen {
+				continue
+			}
+			rooted[nodeID] = append(rooted[nodeID], peerID)
+			rooted[peerID] = []string{}
+			queue = append(queue, peerID)
+		}
+	}
+
+	return rooted
+}
+
+// neighbors returns the children of nodeID and its parent, if it has one
+func neighbors(tree map[string][]string, nodeID string) []string {
+	result := slices.Clone(tree[nodeID])
+	for parent, children := range tree {
+		if slices.Contains(children, nodeID) && !slices.Contains(result, parent) {
+			result = append(result, parent)
+		}
+	}
+
+	return result
+}
@@ -8,20 +8,20 @@ import (
 
 type Batcher struct {
 	mu        sync.Mutex
-	batches   map[string][]int
+	batches   map[string][]Entry
 	ticker    *time.Ticker
 	flushChan chan FlushEvent
 }
 
 type FlushEvent struct {
-	PeerID   string
-	Messages []int
+	PeerID  string
+	Entries []Entry
 }
 
 func NewBatcher(batchTimeout time.Duration) *Batcher {
 	return &Batcher{
 		ticker:    time.NewTicker(batchTimeout),
-		batches:   make(map[string][]int),
+		batches:   make(map[string][]Entry),
 		flushChan: make(chan FlushEvent),
 	}
 }
@@ -29,25 +29,71 @@ func NewBatcher(batchTimeout time.Duration) *Batcher {
 func (b *Batcher) Run() {
 	for range b.ticker.C {
 		b.mu.Lock()
-		for peerID, messages := range b.batches {
-			if len(messages) > 0 {
+		now := time.Now().UnixNano()
+		for peerID, entries := range b.batches {
+			for i := range entries {
+				if entries[i].Trace.Valid() {
+					entries[i].Trace.FlushedAt = now
+				}
+			}
+
+			if len(entries) > 0 {
 				b.flushChan <- FlushEvent{
-					PeerID:   peerID,
-					Messages: messages,
+					PeerID:  peerID,
+					Entries: entries,
 				}
 			}
 		}
-		b.batches = make(map[string][]int)
+		b.batches = make(map[string][]Entry)
 		b.mu.Unlock()
 	}
 }
 
-func (b *Batcher) Add(peerID string, message int) {
+func (b *Batcher) Add(peerID string, entry Entry) {
+	if entry.Trace.Valid() {
+		entry.Trace.QueuedAt = time.Now().UnixNano()
+	}
+
 	b.mu.Lock()
-	b.batches[peerID] = append(b.batches[peerID], message)
+	b.batches[peerID] = append(b.batches[peerID], entry)
 	b.mu.Unlock()
 }
 
+// Take removes and returns the entries waiting for peerID
+func (b *Batcher) Take(peerID string) []Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entries := b.batches[peerID]
+	delete(b.batches, peerID)
+
+	return entries
+}
+
+// Drain removes and returns everything that is waiting
+func (b *Batcher) Drain() map[string][]Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	batches := b.batches
+	b.batches = make(map[string][]Entry)
+
+	return batches
+}
+
+// QueueLengths returns how many entries are waiting for each peer
+func (b *Batcher) QueueLengths() map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lengths := make(map[string]int, len(b.batches))
+	for peerID, entries := range b.batches {
+		lengths[peerID] = len(entries)
+	}
+
+	return lengths
+}
+
 func (b *Batcher) Close() {
 	log.Printf("Closing batcher")
 
@@ -0,0 +1,70 @@
+package main
+
+// CausalBuffer holds entries back until everything they causally depend on
+// has been delivered. Only delivered entries are visible to reads.
+type CausalBuffer struct {
+	delivered VersionVector
+	pending   []Entry
+	values    []int
+}
+
+func NewCausalBuffer() *CausalBuffer {
+	return &CausalBuffer{delivered: make(VersionVector)}
+}
+
+// Deps returns the dependencies of an entry broadcast right now, that is
+// everything a read on this node could have returned so far
+func (c *CausalBuffer) Deps() VersionVector {
+	deps := make(VersionVector, len(c.delivered))
+	for origin, seq := range c.delivered {
+		deps[origin] = seq
+	}
+
+	return deps
+}
+
+// Add buffers a new entry and delivers whatever became deliverable
+func (c *CausalBuffer) Add(e Entry) {
+	c.pending = append(c.pending, e)
+
+	for progress := true; progress; {
+		progress = false
+
+		remaining := c.pending[:0]
+		for _, p := range c.pending {
+			if c.deliverable(p) {
+				c.delivered[p.Origin] = p.Seq
+				c.values = append(c.values, p.Value)
+				progress = true
+			} else {
+				remaining = append(remaining, p)
+			}
+		}
+		c.pending = remaining
+	}
+}
+
+func (c *CausalBuffer) deliverable(e Entry) bool {
+	if c.delivered[e.Origin]+1 != e.Seq {
+		return false
+	}
+
+	for origin, seq := range e.Deps {
+		if origin != e.Origin && c.delivered[origin] < seq {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *CausalBuffer) Values() []int {
+	values := make([]int, len(c.values))
+	copy(values, c.values)
+
+	return values
+}
+
+func (c *CausalBuffer) PendingLen() int {
+	return len(c.pending)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+type DebugStateMessage struct {
+	Type string `json:"type"`
+}
+
+type DebugStateMessageResponse struct {
+	Type            string              `json:"type"`
+	NodeID          string              `json:"node_id"`
+	Mode            string              `json:"mode"`
+	Role            string              `json:"role"`
+	Master          string              `json:"master"`
+	Sequencer       string              `json:"sequencer,omitempty"`
+	Topology        map[string][]string `json:"topology"`
+	AliveMembers    []string            `json:"alive_members"`
+	SetSize         int                 `json:"set_size"`
+	Counter         uint64              `json:"counter"`
+	Vector          VersionVector       `json:"vector"`
+	CausalPending   int                 `json:"causal_pending,omitempty"`
+	BatcherQueues   map[string]int      `json:"batcher_queues"`
+	InFlightRetries int                 `json:"in_flight_retries"`
+	UptimeMs        int64               `json:"uptime_ms"`
+}
+
+func (s *Server) debugStateHandler(msg maelstrom.Message) error {
+	var body DebugStateMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	// The batcher holds its lock while flushing, so ask it before taking ours
+	batcherQueues := s.batcher.QueueLengths()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	debugStateMessageResponse := DebugStateMessageResponse{
+		Type:            "debug_state_ok",
+		NodeID:          s.nodeID,
+		Mode:            s.mode,
+		Role:            s.role,
+		Master:          s.masterNode,
+		Topology:        s.topology,
+		AliveMembers:    s.detector.AliveMembers(),
+		SetSize:         s.entries.Len(),
+		Counter:         s.seq,
+		Vector:          s.entries.Vector(),
+		BatcherQueues:   batcherQueues,
+		InFlightRetries: s.retrier.InFlight(),
+		UptimeMs:        time.Since(s.startedAt).Milliseconds(),
+	}
+
+	switch s.mode {
+	case ModeCausal:
+		debugStateMessageResponse.CausalPending = s.causal.PendingLen()
+	case ModeTotal:
+		debugStateMessageResponse.Sequencer = s.sequencer.Leader()
+	}
+
+	return s.node.Reply(msg, debugStateMessageResponse)
+}
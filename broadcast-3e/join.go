@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/membership"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Sent by an operator to a freshly started node
+type JoinMessage struct {
+	Type string `json:"type"`
+	// Member to bootstrap from, any alive member when empty
+	Seed string `json:"seed,omitempty"`
+}
+
+type JoinMessageResponse struct {
+	Type    string   `json:"type"`
+	Members []string `json:"members"`
+}
+
+// Sent by the joining node to its seed
+type JoinClusterMessage struct {
+	Type string `json:"type"`
+}
+
+type JoinClusterMessageResponse struct {
+	Type    string   `json:"type"`
+	Members []string `json:"members"`
+}
+
+// Sent by an operator to the node that is decommissioned
+type LeaveMessage struct {
+	Type string `json:"type"`
+}
+
+type LeaveMessageResponse struct {
+	Type string `json:"type"`
+}
+
+func (s *Server) joinHandler(msg maelstrom.Message) error {
+	var body JoinMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	// The sequencer's candidates are fixed at init
+	if s.mode == ModeTotal {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "membership changes are not supported in total order mode")
+	}
+
+	seed := body.Seed
+	if seed == "" {
+		alive := s.detector.AliveMembers()
+		if len(alive) == 0 {
+			return maelstrom.NewRPCError(maelstrom.PreconditionFailed, "no member to join through")
+		}
+		seed = alive[0]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.RPC.Timeout.Duration())
+	defer cancel()
+
+	resp, err := s.node.SyncRPC(ctx, seed, JoinClusterMessage{Type: "join_cluster"})
+	if err != nil {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "seed "+seed+" did not let us in: "+err.Error())
+	}
+
+	var joinClusterMessageResponse JoinClusterMessageResponse
+	if err := json.Unmarshal(resp.Body, &joinClusterMessageResponse); err != nil {
+		return err
+	}
+
+	for _, peerID := range joinClusterMessageResponse.Members {
+		s.detector.Join(peerID)
+	}
+
+	// Bootstrap: pull everything the seed has, our vector is empty
+	added, err := s.pull(seed)
+	if err != nil {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "could not copy state from "+seed+": "+err.Error())
+	}
+	log.Printf("Copied %d entries from %s", added, seed)
+
+	members := s.detector.Members()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	topology := fanoutTopology(s.upMembers(members), membershipFanout)
+	if err := s.persist(walRecord{Topology: topology}); err != nil {
+		return err
+	}
+	s.useTopology(topology)
+
+	log.Printf("Joined the cluster through %s, members: %v", seed, members)
+
+	joinMessageResponse := JoinMessageResponse{
+		Type:    "join_ok",
+		Members: members,
+	}
+
+	return s.node.Reply(msg, joinMessageResponse)
+}
+
+func (s *Server) joinClusterHandler(msg maelstrom.Message) error {
+	var body JoinClusterMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	if s.mode == ModeTotal {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "membership changes are not supported in total order mode")
+	}
+
+	// The topology follows through the membership event
+	s.detector.Join(msg.Src)
+
+	joinClusterMessageResponse := JoinClusterMessageResponse{
+		Type:    "join_cluster_ok",
+		Members: s.detector.Members(),
+	}
+
+	return s.node.Reply(msg, joinClusterMessageResponse)
+}
+
+// Hands off whatever is still batched, waits for forwards in flight and only
+// then tells the cluster we are gone. The node keeps answering reads until it
+// is stopped, but takes no new broadcasts.
+func (s *Server) leaveHandler(msg maelstrom.Message) error {
+	var body LeaveMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	if s.mode == ModeTotal {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "membership changes are not supported in total order mode")
+	}
+
+	s.mu.Lock()
+	leaving := s.leaving
+	s.leaving = true
+	s.mu.Unlock()
+
+	if !leaving {
+		s.handOff(s.batcher.Drain())
+
+		deadline := time.Now().Add(s.cfg.RPC.Timeout.Duration())
+		for s.retrier.InFlight() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		s.detector.Leave()
+	}
+
+	leaveMessageResponse := LeaveMessageResponse{
+		Type: "leave_ok",
+	}
+
+	return s.node.Reply(msg, leaveMessageResponse)
+}
+
+// handOff delivers the batches right away. A batch whose peer does not answer
+// goes to another alive member instead, so that it outlives us and anti-entropy
+// can carry it the rest of the way.
+func (s *Server) handOff(batches map[string][]Entry) {
+	send := func(peerID string, entries []Entry) error {
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.RPC.Timeout.Duration())
+		defer cancel()
+
+		_, err := s.node.SyncRPC(ctx, peerID, BroadcastInternalMessage{Type: "broadcast_internal", Entries: entries})
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for peerID, entries := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := send(peerID, entries); err == nil {
+				return
+			}
+
+			for _, successorID := range s.detector.AliveMembers() {
+				if successorID == peerID {
+					continue
+				}
+				if err := send(successorID, entries); err == nil {
+					log.Printf("Handed off %d entries for node %s to %s", len(entries), peerID, successorID)
+					return
+				}
+			}
+
+			log.Printf("Failed to hand off %d entries for node %s", len(entries), peerID)
+		}()
+	}
+	wg.Wait()
+}
+
+// Joins, departures and deaths make the controller's topology stale, from then
+// on every node derives the same tree from the members that are up
+func (s *Server) membershipChanges(events <-chan membership.Event) {
+	for event := range events {
+		if isUp(event.From) == isUp(event.To) {
+			continue
+		}
+
+		topology := fanoutTopology(s.upMembers(s.detector.Members()), membershipFanout)
+
+		s.mu.Lock()
+		if err := s.persist(walRecord{Topology: topology}); err != nil {
+			log.Printf("Failed to persist topology: %v", err)
+		} else {
+			s.useTopology(topology)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// upMembers drops the members the detector holds dead, a dead inner node of
+// the tree would cut off everything below it
+func (s *Server) upMembers(members []string) []string {
+	return slices.DeleteFunc(slices.Clone(members), func(nodeID string) bool {
+		return !s.detector.Alive(nodeID)
+	})
+}
+
+func isUp(state membership.State) bool {
+	return state != membership.Dead && state != membership.Left
+}
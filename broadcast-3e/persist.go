@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/storage"
+)
+
+// walRecord is a single wal entry. Replaying it twice is harmless, since
+// the entry log ignores entries it has already seen.
+type walRecord struct {
+	Entries  []Entry             `json:"entries,omitempty"`
+	Topology map[string][]string `json:"topology,omitempty"`
+}
+
+type snapshotState struct {
+	Entries  []Entry             `json:"entries"`
+	Topology map[string][]string `json:"topology,omitempty"`
+}
+
+// recoverState opens the node's data directory and replays the snapshot and
+// the wal on top of it. Whatever happened while we were down is fetched from
+// peers by anti-entropy, which only transfers entries our vector does not cover.
+// Must be called with s.mu held.
+func (s *Server) recoverState() error {
+	store, err := storage.Open(filepath.Join(s.cfg.DataDir, s.nodeID))
+	if err != nil {
+		return err
+	}
+
+	snapshot, records, err := store.Recover()
+	if err != nil {
+		return err
+	}
+
+	if snapshot != nil {
+		var state snapshotState
+		if err := json.Unmarshal(snapshot, &state); err != nil {
+			return fmt.Errorf("decode snapshot: %w", err)
+		}
+
+		s.applyRecord(walRecord{Entries: state.Entries, Topology: state.Topology})
+	}
+
+	for _, r := range records {
+		var record walRecord
+		if err := json.Unmarshal(r, &record); err != nil {
+			return fmt.Errorf("decode wal record: %w", err)
+		}
+
+		s.applyRecord(record)
+	}
+
+	s.store = store
+	log.Printf("Recovered %d entries, own sequence number: %d", s.entries.Len(), s.seq)
+
+	if s.mode == ModeTotal {
+		if err := s.sequencer.Recover(filepath.Join(s.cfg.DataDir, s.nodeID, "sequencer")); err != nil {
+			return fmt.Errorf("recover sequencer: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) applyRecord(record walRecord) {
+	for _, e := range record.Entries {
+		s.addEntry(e)
+
+		if e.Origin == s.nodeID && e.Seq > s.seq {
+			s.seq = e.Seq
+		}
+	}
+
+	if record.Topology != nil {
+		s.useTopology(record.Topology)
+	}
+}
+
+// persist appends the record to the wal, it is a no-op when no data directory is configured.
+// Must be called with s.mu held.
+func (s *Server) persist(record walRecord) error {
+	if s.store == nil || (len(record.Entries) == 0 && record.Topology == nil) {
+		return nil
+	}
+
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return s.store.Append(buf)
+}
+
+func (s *Server) snapshots() {
+	for range s.snapshotTicker.C {
+		s.mu.Lock()
+		if s.store == nil {
+			s.mu.Unlock()
+			continue
+		}
+
+		state := snapshotState{
+			Entries:  s.entries.Missing(VersionVector{}),
+			Topology: s.topology,
+		}
+
+		buf, err := json.Marshal(state)
+		if err == nil {
+			err = s.store.Snapshot(buf)
+		}
+		s.mu.Unlock()
+
+		if err != nil {
+			log.Printf("Failed to write snapshot: %v", err)
+		}
+	}
+}
+
+// sequencerRecord is a single entry of the sequencer's wal, zero fields did
+// not change. A suffix replaces the order from its start on, like an
+// order_append does, so replaying it twice is harmless.
+type sequencerRecord struct {
+	Promised  Epoch        `json:"promised,omitzero"`
+	LogEpoch  Epoch        `json:"log_epoch,omitzero"`
+	Suffix    *orderSuffix `json:"suffix,omitempty"`
+	Committed int          `json:"committed,omitempty"`
+}
+
+type orderSuffix struct {
+	Start   int     `json:"start"`
+	Entries []Entry `json:"entries"`
+}
+
+type sequencerSnapshot struct {
+	Promised  Epoch   `json:"promised"`
+	LogEpoch  Epoch   `json:"log_epoch"`
+	Order     []Entry `json:"order"`
+	Committed int     `json:"committed"`
+}
+
+// The sequencer snapshots once its wal holds this many records
+const sequencerSnapshotEvery = 1000
+
+// Recover opens the sequencer's own store and replays it. A node must not
+// forget an epoch it promised, or it could help two leaders into the same
+// epoch, nor the order it acknowledged, which a majority is counted on.
+func (q *Sequencer) Recover(dir string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	store, err := storage.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	snapshot, records, err := store.Recover()
+	if err != nil {
+		return err
+	}
+
+	if snapshot != nil {
+		var state sequencerSnapshot
+		if err := json.Unmarshal(snapshot, &state); err != nil {
+			return fmt.Errorf("decode sequencer snapshot: %w", err)
+		}
+
+		q.promised = state.Promised
+		q.logEpoch = state.LogEpoch
+		q.order = state.Order
+		q.committed = min(state.Committed, len(q.order))
+	}
+
+	for _, r := range records {
+		var record sequencerRecord
+		if err := json.Unmarshal(r, &record); err != nil {
+			return fmt.Errorf("decode sequencer wal record: %w", err)
+		}
+
+		q.applyRecord(record)
+	}
+
+	q.store = store
+	q.records = len(records)
+	log.Printf("Recovered sequencer in epoch %+v with %d ordered entries, %d committed", q.promised, len(q.order), q.committed)
+
+	return nil
+}
+
+// update writes the record to the wal before applying it, so nothing is acted
+// on or acknowledged that a restart would forget. Must be called with q.mu held.
+func (q *Sequencer) update(record sequencerRecord) error {
+	if q.store != nil && record != (sequencerRecord{}) {
+		buf, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		if err := q.store.Append(buf); err != nil {
+			return err
+		}
+		q.records++
+	}
+
+	q.applyRecord(record)
+
+	if q.records >= sequencerSnapshotEvery {
+		q.snapshotLocked()
+	}
+
+	return nil
+}
+
+func (q *Sequencer) applyRecord(record sequencerRecord) {
+	if q.promised.Less(record.Promised) {
+		q.promised = record.Promised
+	}
+
+	if record.LogEpoch != (Epoch{}) {
+		q.logEpoch = record.LogEpoch
+	}
+
+	if record.Suffix != nil {
+		start := min(record.Suffix.Start, len(q.order))
+		q.order = append(q.order[:start:start], record.Suffix.Entries...)
+	}
+
+	if record.Committed > 0 {
+		q.committed = min(record.Committed, len(q.order))
+	}
+}
+
+// Must be called with q.mu held
+func (q *Sequencer) snapshotLocked() {
+	state := sequencerSnapshot{
+		Promised:  q.promised,
+		LogEpoch:  q.logEpoch,
+		Order:     q.order,
+		Committed: q.committed,
+	}
+
+	buf, err := json.Marshal(state)
+	if err == nil {
+		err = q.store.Snapshot(buf)
+	}
+
+	if err != nil {
+		log.Printf("Failed to write sequencer snapshot: %v", err)
+		return
+	}
+
+	q.records = 0
+}
@@ -0,0 +1,700 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/membership"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/storage"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Epoch identifies a sequencer reign. Epochs are ordered by term first, the
+// leader ID only breaks ties between two nodes which took over concurrently.
+type Epoch struct {
+	Term   int    `json:"term"`
+	Leader string `json:"leader"`
+}
+
+func (e Epoch) Less(other Epoch) bool {
+	if e.Term != other.Term {
+		return e.Term < other.Term
+	}
+
+	return e.Leader < other.Leader
+}
+
+type entryKey struct {
+	origin string
+	seq    uint64
+}
+
+// Sequencer puts entries in a single order that every node agrees on. The
+// leader appends entries it learns about to its log and replicates the log to
+// every follower; a position is committed (and visible to reads) once a
+// majority stores it. When the leader dies, the first alive node in the
+// candidate list collects logs from a majority and continues from the most
+// up to date one.
+type Sequencer struct {
+	node       *maelstrom.Node
+	detector   *membership.Detector
+	rpcTimeout time.Duration
+
+	mu         sync.Mutex
+	nodeID     string
+	candidates []string
+	peers      []string
+
+	promised  Epoch
+	logEpoch  Epoch
+	order     []Entry
+	committed int
+
+	leading bool
+	// The order's length when we took over and the epoch it was written in, a
+	// follower only switches to our epoch once it holds all of it
+	base       int
+	baseEpoch  Epoch
+	matchIndex map[string]int
+	nextIndex  map[string]int
+	sequenced  map[entryKey]struct{}
+	known      map[entryKey]Entry
+	inbox      []Entry
+
+	// Pages of a new leader's order that do not reach its base yet
+	catchUp catchUp
+
+	// Nil without a data directory
+	store   *storage.Store
+	records int
+
+	ticker *time.Ticker
+}
+
+// catchUp collects a new leader's order on a follower. The pages only replace
+// the follower's order together, a partial copy under the new epoch could win
+// a later takeover without the entries committed before it.
+type catchUp struct {
+	epoch   Epoch
+	start   int
+	entries []Entry
+}
+
+func (c *catchUp) end() int {
+	return c.start + len(c.entries)
+}
+
+type OrderAppendMessage struct {
+	Type    string  `json:"type"`
+	Epoch   Epoch   `json:"epoch"`
+	Start   int     `json:"start"`
+	Entries []Entry `json:"entries"`
+	Commit  int     `json:"commit"`
+	// The leader's order length at takeover and the epoch it was written in
+	Base      int   `json:"base"`
+	BaseEpoch Epoch `json:"base_epoch"`
+}
+
+type OrderAppendMessageResponse struct {
+	Type string `json:"type"`
+	// How much of the order we store in the leader's epoch, zero while
+	// catching up
+	Length int `json:"length"`
+	// Where the next append should start
+	Next int `json:"next"`
+}
+
+type OrderPromiseMessage struct {
+	Type  string `json:"type"`
+	Epoch Epoch  `json:"epoch"`
+}
+
+type OrderPromiseMessageResponse struct {
+	Type      string `json:"type"`
+	LogEpoch  Epoch  `json:"log_epoch"`
+	Length    int    `json:"length"`
+	Committed int    `json:"committed"`
+}
+
+// The new leader copies the most up to date order from its voter page by page
+type OrderFetchMessage struct {
+	Type  string `json:"type"`
+	Epoch Epoch  `json:"epoch"`
+	Start int    `json:"start"`
+}
+
+type OrderFetchMessageResponse struct {
+	Type    string  `json:"type"`
+	Entries []Entry `json:"entries"`
+}
+
+func NewSequencer(n *maelstrom.Node, d *membership.Detector, interval, rpcTimeout time.Duration) *Sequencer {
+	q := &Sequencer{
+		node:       n,
+		detector:   d,
+		rpcTimeout: rpcTimeout,
+		matchIndex: make(map[string]int),
+		nextIndex:  make(map[string]int),
+		sequenced:  make(map[entryKey]struct{}),
+		known:      make(map[entryKey]Entry),
+		ticker:     time.NewTicker(interval),
+	}
+
+	q.node.Handle("order_append", q.appendHandler)
+	q.node.Handle("order_promise", q.promiseHandler)
+	q.node.Handle("order_fetch", q.fetchHandler)
+
+	return q
+}
+
+// Init sets up the candidate list: the preferred node goes first, then
+// everybody else in the same order on every node
+func (q *Sequencer) Init(nodeID string, nodeIDs []string, preferred string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.nodeID = nodeID
+
+	sorted := append([]string(nil), nodeIDs...)
+	sort.Strings(sorted)
+
+	for _, id := range nodeIDs {
+		if id == preferred {
+			q.candidates = append(q.candidates, preferred)
+		}
+	}
+	for _, id := range sorted {
+		if id != preferred {
+			q.candidates = append(q.candidates, id)
+		}
+		if id != nodeID {
+			q.peers = append(q.peers, id)
+		}
+	}
+
+	log.Printf("Sequencer candidates: %v", q.candidates)
+}
+
+// Offer hands over an entry that should eventually get a position in the order
+func (q *Sequencer) Offer(e Entry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := entryKey{origin: e.Origin, seq: e.Seq}
+	q.known[key] = e
+	if q.leading {
+		q.inbox = append(q.inbox, e)
+	}
+}
+
+// Values returns the committed prefix of the order
+func (q *Sequencer) Values() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	values := make([]int, 0, q.committed)
+	for _, e := range q.order[:q.committed] {
+		values = append(values, e.Value)
+	}
+
+	return values
+}
+
+// Leader returns the node of the newest epoch we know of
+func (q *Sequencer) Leader() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.promised.Leader
+}
+
+func (q *Sequencer) Run() {
+	for range q.ticker.C {
+		q.tick()
+	}
+}
+
+func (q *Sequencer) Close() {
+	log.Printf("Closing sequencer")
+
+	q.ticker.Stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.store != nil {
+		if err := q.store.Close(); err != nil {
+			log.Printf("Failed to close sequencer store: %v", err)
+		}
+	}
+}
+
+// noCandidate is what nextCandidate returns when nobody can lead. Maelstrom
+// node IDs never contain a NUL byte, so it cannot match ours.
+const noCandidate = "\x00"
+
+func (q *Sequencer) tick() {
+	q.mu.Lock()
+	nodeID := q.nodeID
+	leader := q.promised.Leader
+	leading := q.leading
+	q.mu.Unlock()
+
+	// Run starts before init arrives, without candidates or peers a takeover
+	// would win on its own vote
+	if nodeID == "" {
+		return
+	}
+
+	if leading {
+		q.replicate()
+		return
+	}
+
+	// Somebody else is in charge and still alive
+	if leader != "" && leader != nodeID && q.detector.Alive(leader) {
+		return
+	}
+
+	if q.nextCandidate() == nodeID {
+		q.takeover()
+	}
+}
+
+func (q *Sequencer) nextCandidate() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, id := range q.candidates {
+		if id == q.nodeID || q.detector.Alive(id) {
+			return id
+		}
+	}
+
+	return noCandidate
+}
+
+// promise is a vote for our takeover, with what the voter's order looks like
+type promise struct {
+	peerID string
+	OrderPromiseMessageResponse
+}
+
+func (q *Sequencer) takeover() {
+	q.mu.Lock()
+	epoch := Epoch{Term: q.promised.Term + 1, Leader: q.nodeID}
+	if err := q.update(sequencerRecord{Promised: epoch}); err != nil {
+		q.mu.Unlock()
+		log.Printf("Failed to persist sequencer epoch %+v: %v", epoch, err)
+		return
+	}
+	ours := promise{
+		peerID: q.nodeID,
+		OrderPromiseMessageResponse: OrderPromiseMessageResponse{
+			LogEpoch:  q.logEpoch,
+			Length:    len(q.order),
+			Committed: q.committed,
+		},
+	}
+	peers := q.peers
+	q.mu.Unlock()
+
+	log.Printf("Taking over as sequencer in epoch %+v", epoch)
+
+	replies := make(chan *promise, len(peers))
+	for _, peerID := range peers {
+		go func() {
+			var body OrderPromiseMessageResponse
+			if err := q.call(peerID, OrderPromiseMessage{Type: "order_promise", Epoch: epoch}, &body); err != nil {
+				replies <- nil
+				return
+			}
+			replies <- &promise{peerID: peerID, OrderPromiseMessageResponse: body}
+		}()
+	}
+
+	best := ours
+	promises := []promise{ours}
+	for range peers {
+		p := <-replies
+		if p == nil {
+			continue
+		}
+
+		promises = append(promises, *p)
+		// The most recently written order wins, ties are broken by length
+		if best.LogEpoch.Less(p.LogEpoch) || (best.LogEpoch == p.LogEpoch && p.Length > best.Length) {
+			best.peerID, best.LogEpoch, best.Length = p.peerID, p.LogEpoch, p.Length
+		}
+		best.Committed = max(best.Committed, p.Committed)
+	}
+
+	if len(promises) <= (len(peers)+1)/2 {
+		log.Printf("Sequencer takeover failed, only %d votes", len(promises))
+		return
+	}
+
+	// Orders written in the same epoch are prefixes of one another, so only
+	// the part we lack has to be copied
+	start := 0
+	if ours.LogEpoch == best.LogEpoch {
+		start = ours.Length
+	}
+
+	var fetched []Entry
+	if best.peerID != ours.peerID {
+		var err error
+		if fetched, err = q.fetchOrder(best.peerID, epoch, start, best.Length); err != nil {
+			log.Printf("Sequencer takeover failed, could not copy the order from %s: %v", best.peerID, err)
+			return
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.promised != epoch {
+		log.Printf("Sequencer takeover superseded by epoch %+v", q.promised)
+		return
+	}
+
+	record := sequencerRecord{LogEpoch: epoch}
+	if best.peerID != ours.peerID {
+		record.Suffix = &orderSuffix{Start: start, Entries: fetched}
+	}
+	if committed := min(best.Committed, best.Length); committed > q.committed {
+		record.Committed = committed
+	}
+	if err := q.update(record); err != nil {
+		log.Printf("Failed to persist the order of epoch %+v: %v", epoch, err)
+		return
+	}
+	q.leading = true
+	q.base = len(q.order)
+	q.baseEpoch = best.LogEpoch
+	q.matchIndex = make(map[string]int)
+	q.nextIndex = make(map[string]int)
+	for _, p := range promises {
+		if p.LogEpoch == best.LogEpoch {
+			q.nextIndex[p.peerID] = p.Length
+		}
+	}
+
+	q.sequenced = make(map[entryKey]struct{}, len(q.order))
+	for _, e := range q.order {
+		q.sequenced[entryKey{origin: e.Origin, seq: e.Seq}] = struct{}{}
+	}
+
+	q.inbox = q.inbox[:0]
+	for key, e := range q.known {
+		if _, exists := q.sequenced[key]; !exists {
+			q.inbox = append(q.inbox, e)
+		}
+	}
+
+	log.Printf("Sequencer leading epoch %+v with %d ordered entries", epoch, len(q.order))
+}
+
+// fetchOrder copies order[start:length] from a peer that promised us epoch
+func (q *Sequencer) fetchOrder(peerID string, epoch Epoch, start, length int) ([]Entry, error) {
+	var entries []Entry
+	for start+len(entries) < length {
+		orderFetchMessage := OrderFetchMessage{
+			Type:  "order_fetch",
+			Epoch: epoch,
+			Start: start + len(entries),
+		}
+
+		var orderFetchMessageResponse OrderFetchMessageResponse
+		if err := q.call(peerID, orderFetchMessage, &orderFetchMessageResponse); err != nil {
+			return nil, err
+		}
+		if len(orderFetchMessageResponse.Entries) == 0 {
+			return nil, fmt.Errorf("order ends at %d, promised %d", start+len(entries), length)
+		}
+		entries = append(entries, orderFetchMessageResponse.Entries...)
+	}
+
+	return entries[:length-start], nil
+}
+
+func (q *Sequencer) call(peerID string, body any, response any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), q.rpcTimeout)
+	defer cancel()
+
+	resp, err := q.node.SyncRPC(ctx, peerID, body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(resp.Body, response)
+}
+
+func (q *Sequencer) replicate() {
+	q.mu.Lock()
+	var fresh []Entry
+	for _, e := range q.inbox {
+		key := entryKey{origin: e.Origin, seq: e.Seq}
+		if _, exists := q.sequenced[key]; !exists {
+			q.sequenced[key] = struct{}{}
+			fresh = append(fresh, e)
+		}
+	}
+
+	// Our own copy counts towards the majority, so it is on disk before anything is sent
+	if len(fresh) > 0 {
+		if err := q.update(sequencerRecord{Suffix: &orderSuffix{Start: len(q.order), Entries: fresh}}); err != nil {
+			for _, e := range fresh {
+				delete(q.sequenced, entryKey{origin: e.Origin, seq: e.Seq})
+			}
+			q.mu.Unlock()
+			log.Printf("Failed to persist %d ordered entries: %v", len(fresh), err)
+			return
+		}
+	}
+	q.inbox = q.inbox[:0]
+
+	epoch := q.promised
+	order := q.order
+	committed := q.committed
+	base, baseEpoch := q.base, q.baseEpoch
+	nextIndex := make(map[string]int, len(q.nextIndex))
+	for peerID, idx := range q.nextIndex {
+		nextIndex[peerID] = idx
+	}
+	peers := q.peers
+	q.mu.Unlock()
+
+	for _, peerID := range peers {
+		if !q.detector.Alive(peerID) {
+			continue
+		}
+
+		// A peer far behind catches up over several ticks
+		start := min(nextIndex[peerID], len(order))
+		end := min(start+maxEntriesPerMessage, len(order))
+		orderAppendMessage := OrderAppendMessage{
+			Type:      "order_append",
+			Epoch:     epoch,
+			Start:     start,
+			Entries:   order[start:end],
+			Commit:    committed,
+			Base:      base,
+			BaseEpoch: baseEpoch,
+		}
+
+		go q.appendToPeer(peerID, epoch, orderAppendMessage)
+	}
+}
+
+func (q *Sequencer) appendToPeer(peerID string, epoch Epoch, body OrderAppendMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), q.rpcTimeout)
+	resp, err := q.node.SyncRPC(ctx, peerID, body)
+	cancel()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.promised != epoch || !q.leading {
+		return
+	}
+
+	if rpcErr, ok := err.(*maelstrom.RPCError); ok && rpcErr.Code == maelstrom.PreconditionFailed {
+		log.Printf("Stepping down as sequencer, %s promised a newer epoch", peerID)
+		q.leading = false
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	var respBody OrderAppendMessageResponse
+	if err := json.Unmarshal(resp.Body, &respBody); err != nil {
+		return
+	}
+
+	q.matchIndex[peerID] = respBody.Length
+	q.nextIndex[peerID] = respBody.Next
+	q.advanceCommitLocked()
+}
+
+func (q *Sequencer) advanceCommitLocked() {
+	lengths := []int{len(q.order)}
+	for _, peerID := range q.peers {
+		lengths = append(lengths, q.matchIndex[peerID])
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(lengths)))
+
+	majority := len(lengths)/2 + 1
+	if committed := lengths[majority-1]; committed > q.committed {
+		if err := q.update(sequencerRecord{Committed: committed}); err != nil {
+			log.Printf("Failed to persist commit index %d: %v", committed, err)
+		}
+	}
+}
+
+func (q *Sequencer) appendHandler(msg maelstrom.Message) error {
+	var body OrderAppendMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if body.Epoch.Less(q.promised) {
+		return maelstrom.NewRPCError(maelstrom.PreconditionFailed, "stale sequencer epoch")
+	}
+
+	var record sequencerRecord
+	if q.promised.Less(body.Epoch) {
+		record.Promised = body.Epoch
+	}
+
+	if q.logEpoch != body.Epoch {
+		return q.catchUpLocked(msg, body, record)
+	}
+
+	// Our order is a prefix of the leader's, so a page we already hold, e.g. a
+	// retry, cannot shorten it. If we are missing a part of the order, the
+	// leader will resend it from our length.
+	length := len(q.order)
+	if end := body.Start + len(body.Entries); body.Start <= length && end > length {
+		record.Suffix = &orderSuffix{Start: length, Entries: body.Entries[length-body.Start:]}
+		length = end
+	}
+	if commit := min(body.Commit, length); commit > q.committed {
+		record.Committed = commit
+	}
+
+	if err := q.update(record); err != nil {
+		return err
+	}
+	if record.Promised != (Epoch{}) {
+		q.leading = false
+	}
+
+	orderAppendMessageResponse := OrderAppendMessageResponse{
+		Type:   "order_append_ok",
+		Length: len(q.order),
+		Next:   len(q.order),
+	}
+
+	return q.node.Reply(msg, orderAppendMessageResponse)
+}
+
+// catchUpLocked collects the pages of a leader whose epoch our order is not
+// in yet. Once they reach the leader's base they replace our order from where
+// they start, in a single record.
+func (q *Sequencer) catchUpLocked(msg maelstrom.Message, body OrderAppendMessage, record sequencerRecord) error {
+	// An order written in the epoch of the leader's base is a prefix of it,
+	// pages can only start where we know that we agree
+	agreed := 0
+	if q.logEpoch == body.BaseEpoch {
+		agreed = len(q.order)
+	}
+
+	c := &q.catchUp
+	if c.epoch != body.Epoch || body.Start < c.start || body.Start > c.end() {
+		*c = catchUp{}
+		if body.Start <= agreed {
+			*c = catchUp{epoch: body.Epoch, start: body.Start}
+		}
+	}
+
+	next := agreed
+	if c.epoch == body.Epoch {
+		// Pages are copies of the same order, a retried one adds nothing
+		if end := body.Start + len(body.Entries); end > c.end() {
+			c.entries = append(c.entries, body.Entries[c.end()-body.Start:]...)
+		}
+		next = c.end()
+
+		if c.end() >= body.Base {
+			record.LogEpoch = body.Epoch
+			record.Suffix = &orderSuffix{Start: c.start, Entries: c.entries}
+			if commit := min(body.Commit, c.end()); commit > q.committed {
+				record.Committed = commit
+			}
+			*c = catchUp{}
+		}
+	}
+
+	if err := q.update(record); err != nil {
+		return err
+	}
+	if record.Promised != (Epoch{}) {
+		q.leading = false
+	}
+
+	orderAppendMessageResponse := OrderAppendMessageResponse{
+		Type: "order_append_ok",
+		Next: next,
+	}
+	if q.logEpoch == body.Epoch {
+		orderAppendMessageResponse.Length = len(q.order)
+		orderAppendMessageResponse.Next = len(q.order)
+	}
+
+	return q.node.Reply(msg, orderAppendMessageResponse)
+}
+
+func (q *Sequencer) promiseHandler(msg maelstrom.Message) error {
+	var body OrderPromiseMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.promised.Less(body.Epoch) {
+		return maelstrom.NewRPCError(maelstrom.PreconditionFailed, "already promised a newer epoch")
+	}
+
+	// The promise is on disk before anybody relies on it
+	if err := q.update(sequencerRecord{Promised: body.Epoch}); err != nil {
+		return err
+	}
+	q.leading = false
+
+	orderPromiseMessageResponse := OrderPromiseMessageResponse{
+		Type:      "order_promise_ok",
+		LogEpoch:  q.logEpoch,
+		Length:    len(q.order),
+		Committed: q.committed,
+	}
+
+	return q.node.Reply(msg, orderPromiseMessageResponse)
+}
+
+// Our order cannot change while we keep the promise, so the pages fit together
+func (q *Sequencer) fetchHandler(msg maelstrom.Message) error {
+	var body OrderFetchMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.promised != body.Epoch {
+		return maelstrom.NewRPCError(maelstrom.PreconditionFailed, "promised another epoch")
+	}
+
+	start := min(max(body.Start, 0), len(q.order))
+	end := min(start+maxEntriesPerMessage, len(q.order))
+
+	orderFetchMessageResponse := OrderFetchMessageResponse{
+		Type:    "order_fetch_ok",
+		Entries: q.order[start:end],
+	}
+
+	return q.node.Reply(msg, orderFetchMessageResponse)
+}
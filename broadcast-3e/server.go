@@ -3,27 +3,63 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/config"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/membership"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/retry"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/storage"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/trace"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
+const (
+	// Every node eventually sees every value, in no particular order
+	ModeEventual = "eventual"
+	// A value is never visible before the values that were visible on its origin when it was broadcast
+	ModeCausal = "causal"
+	// Every node delivers values in the same order, reads return a prefix of it
+	ModeTotal = "total"
+)
+
 type Server struct {
-	node   *maelstrom.Node
-	nodeID string
+	node      *maelstrom.Node
+	nodeID    string
+	startedAt time.Time
+	cfg       config.Config
+
+	mu      sync.Mutex
+	entries *EntryLog
+	seq     uint64
 
-	mu       sync.Mutex
-	messages map[int]struct{}
+	mode      string
+	causal    *CausalBuffer
+	sequencer *Sequencer
 
 	topology   map[string][]string
 	masterNode string
 
 	role string
 
+	detector     *membership.Detector
+	memberEvents <-chan membership.Event
+	retrier      *retry.Retrier
+	leaving      bool
+
 	batcher *Batcher
+
+	antiEntropyTicker *time.Ticker
+
+	store          *storage.Store
+	snapshotTicker *time.Ticker
+
+	// nil unless tracing is enabled
+	tracer *trace.Tracer
 }
 
 type BroadcastMessage struct {
@@ -36,14 +72,27 @@ type BroadcastMessageResponse struct {
 }
 
 type BroadcastInternalMessage struct {
-	Type     string `json:"type"`
-	Messages []int  `json:"messages"`
+	Type    string              `json:"type"`
+	Entries []Entry             `json:"entries"`
+	Members []membership.Update `json:"members,omitempty"`
 }
 
 type BroadcastInternalMessageResponse struct {
 	Type string `json:"type"`
 }
 
+type SyncMessage struct {
+	Type   string        `json:"type"`
+	Vector VersionVector `json:"vector"`
+}
+
+type SyncMessageResponse struct {
+	Type    string  `json:"type"`
+	Entries []Entry `json:"entries"`
+	// The peer has more, ask again with the vector moved past these entries
+	More bool `json:"more"`
+}
+
 type ReadMessage struct {
 	Type string `json:"type"`
 }
@@ -62,15 +111,45 @@ type ReadMessageResponse struct {
 	Messages []int  `json:"messages"`
 }
 
-func NewServer(n *maelstrom.Node) *Server {
-	b := NewBatcher(200 * time.Millisecond)
-	s := &Server{node: n, messages: make(map[int]struct{}), batcher: b}
+func NewServer(n *maelstrom.Node, cfg config.Config) *Server {
+	b := NewBatcher(cfg.Broadcast.BatchInterval.Duration())
+	d := membership.NewDetector(n, cfg.Membership.ProbeInterval.Duration(), cfg.Membership.SuspicionTimeout.Duration())
+	s := &Server{
+		node:      n,
+		startedAt: time.Now(),
+		cfg:       cfg,
+		entries:   NewEntryLog(),
+		mode:      cfg.Broadcast.Mode,
+		batcher:   b,
+		detector:  d,
+		// Subscribed before init, so that no join is missed
+		memberEvents:      d.Subscribe(),
+		retrier:           retry.New(cfg.Retry.Policy()),
+		antiEntropyTicker: time.NewTicker(cfg.Broadcast.AntiEntropyInterval.Duration()),
+		snapshotTicker:    time.NewTicker(cfg.Broadcast.SnapshotInterval.Duration()),
+	}
+
+	if cfg.TraceDir != "" {
+		s.tracer = trace.NewTracer(cfg.TraceDir, "broadcast-3e")
+	}
+
+	switch s.mode {
+	case ModeCausal:
+		s.causal = NewCausalBuffer()
+	case ModeTotal:
+		s.sequencer = NewSequencer(n, d, cfg.Broadcast.SequencerInterval.Duration(), cfg.RPC.Timeout.Duration())
+	}
 
 	s.node.Handle("init", s.initHandler)
 	s.node.Handle("broadcast", s.broadcastHandler)
 	s.node.Handle("broadcast_internal", s.broadcastInternalHandler)
+	s.node.Handle("sync", s.syncHandler)
 	s.node.Handle("read", s.readHandler)
 	s.node.Handle("topology", s.topologyHandler)
+	s.node.Handle("debug_state", s.debugStateHandler)
+	s.node.Handle("join", s.joinHandler)
+	s.node.Handle("join_cluster", s.joinClusterHandler)
+	s.node.Handle("leave", s.leaveHandler)
 
 	// no-op handlers
 	s.node.Handle("broadcast_ok", s.noOpHandler)
@@ -82,10 +161,11 @@ func NewServer(n *maelstrom.Node) *Server {
 func (s *Server) handleFlushes() {
 	for event := range s.batcher.flushChan {
 		msg := BroadcastInternalMessage{
-			Type:     "broadcast_internal",
-			Messages: event.Messages,
+			Type:    "broadcast_internal",
+			Entries: event.Entries,
+			Members: s.detector.Piggyback(),
 		}
-		go broadcastMessageToPeer(s.node, event.PeerID, msg)
+		go s.broadcastMessageToPeer(event.PeerID, msg)
 	}
 }
 
@@ -95,42 +175,91 @@ func (s *Server) initHandler(msg maelstrom.Message) error {
 
 	var body maelstrom.InitMessageBody
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	s.nodeID = body.NodeID
 	log.Printf("Node id set to: %s", s.nodeID)
 
+	s.detector.Init(body.NodeID, body.NodeIDs)
+
+	if err := s.tracer.Init(body.NodeID); err != nil {
+		return maelstrom.NewRPCError(maelstrom.Crash, "open trace file: "+err.Error())
+	}
+
+	if s.mode == ModeTotal {
+		s.sequencer.Init(body.NodeID, body.NodeIDs, s.cfg.Broadcast.MasterNode)
+	}
+
+	if s.cfg.DataDir != "" {
+		if err := s.recoverState(); err != nil {
+			return maelstrom.NewRPCError(maelstrom.Crash, "recover state: "+err.Error())
+		}
+	}
+
 	return nil
 }
 
 func (s *Server) broadcastHandler(msg maelstrom.Message) error {
+	receivedAt := time.Now()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	var body BroadcastMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
-	// To avoid cycles: n0->n1->n2->n0
-	if _, exists := s.messages[body.Message]; exists {
-		broadcastMessageResponse := BroadcastMessageResponse{
-			Type: "broadcast_ok",
-		}
+	if s.leaving {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "node is leaving the cluster")
+	}
 
-		return s.node.Reply(msg, broadcastMessageResponse)
+	// Every client broadcast is a new entry, even if the value was seen before
+	entry := Entry{Origin: s.nodeID, Seq: s.seq + 1, Value: body.Message}
+	if s.mode == ModeCausal {
+		entry.Deps = s.causal.Deps()
+	}
+	if s.tracer.Enabled() {
+		entry.Trace = trace.Context{TraceID: trace.NewTraceID(), SpanID: trace.NewSpanID()}
+		defer s.tracer.Record(trace.Span{
+			TraceID: entry.Trace.TraceID,
+			SpanID:  entry.Trace.SpanID,
+			Name:    "broadcast",
+			Start:   receivedAt,
+			End:     time.Now(),
+			Attributes: map[string]any{
+				"node.id":          s.nodeID,
+				"client":           msg.Src,
+				"broadcast.value":  entry.Value,
+				"broadcast.origin": entry.Origin,
+				"broadcast.seq":    int64(entry.Seq),
+				"hop":              0,
+			},
+		})
 	}
 
-	s.messages[body.Message] = struct{}{}
+	if err := s.persist(walRecord{Entries: []Entry{entry}}); err != nil {
+		return err
+	}
+
+	s.seq = entry.Seq
+	s.addEntry(entry)
 
 	for _, peerID := range s.topology[s.nodeID] {
-		s.batcher.Add(peerID, body.Message)
+		s.batcher.Add(peerID, entry)
 	}
 
 	if s.role == "FOLLOWER" {
-		// Broadcast to the master node
-		s.batcher.Add(s.masterNode, body.Message)
+		if s.detector.Alive(s.masterNode) {
+			// Broadcast to the master node
+			s.batcher.Add(s.masterNode, entry)
+		} else {
+			// The tree is cut without its root, reach everybody directly instead
+			for _, peerID := range s.detector.AliveMembers() {
+				s.batcher.Add(peerID, entry)
+			}
+		}
 	}
 
 	broadcastMessageResponse := BroadcastMessageResponse{
@@ -146,55 +275,280 @@ func (s *Server) broadcastInternalHandler(msg maelstrom.Message) error {
 
 	var body BroadcastInternalMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	s.detector.Merge(body.Members)
+
+	// To avoid cycles: n0->n1->n2->n0
+	unseenEntries, err := s.acceptEntries("broadcast_internal", msg.Src, body.Entries)
+	if err != nil {
 		return err
 	}
 
-	var unseenMessages []int
+	for _, e := range unseenEntries {
+		for _, peerID := range s.topology[s.nodeID] {
+			s.batcher.Add(peerID, e)
+		}
+	}
+
+	broadcastInternalMessageResponse := BroadcastInternalMessageResponse{
+		Type: "broadcast_internal_ok",
+	}
+
+	return s.node.Reply(msg, broadcastInternalMessageResponse)
+}
+
+// continueTrace returns the context an arriving entry is stored and forwarded
+// with. Nodes without a tracer drop it, so the trace ends there.
+func (s *Server) continueTrace(received trace.Context) trace.Context {
+	if !received.Valid() || !s.tracer.Enabled() {
+		return trace.Context{}
+	}
+
+	return received.Child()
+}
+
+// traceHop records the span of an entry reaching this node, from the moment the
+// sender queued it until it arrived. Entries pulled by a sync were never queued,
+// their span only marks the arrival.
+func (s *Server) traceHop(name, peerID string, e Entry, received trace.Context) {
+	if !e.Trace.Valid() {
+		return
+	}
+
+	now := time.Now()
+	start := now
+	if received.QueuedAt > 0 {
+		start = time.Unix(0, received.QueuedAt)
+	}
+
+	attributes := map[string]any{
+		"node.id":          s.nodeID,
+		"peer":             peerID,
+		"broadcast.value":  e.Value,
+		"broadcast.origin": e.Origin,
+		"broadcast.seq":    int64(e.Seq),
+		"hop":              e.Trace.Hop,
+	}
+	// Time in the sender's batcher, and from the flush to us, retries included
+	if received.QueuedAt > 0 && received.FlushedAt > 0 {
+		attributes["batcher.wait_ms"] = float64(received.FlushedAt-received.QueuedAt) / 1e6
+		attributes["transit_ms"] = float64(now.UnixNano()-received.FlushedAt) / 1e6
+	}
+
+	s.tracer.Record(trace.Span{
+		TraceID:      e.Trace.TraceID,
+		SpanID:       e.Trace.SpanID,
+		ParentSpanID: received.SpanID,
+		Name:         name,
+		Start:        start,
+		End:          now,
+		Attributes:   attributes,
+	})
+}
+
+// acceptEntries stores the entries a peer sent that we have not seen yet, each
+// once, and returns them. They are in the wal before anything else sees them.
+// Must be called with s.mu held.
+func (s *Server) acceptEntries(name, peerID string, entries []Entry) ([]Entry, error) {
+	var unseen []Entry
+	// What the entries carried when they arrived, the stored ones continue it
+	var received []trace.Context
+
+	keys := make(map[entryKey]struct{})
+	for _, e := range entries {
+		key := entryKey{origin: e.Origin, seq: e.Seq}
+		if _, exists := keys[key]; exists || s.entries.Contains(e) {
+			continue
+		}
+		keys[key] = struct{}{}
+
+		received = append(received, e.Trace)
+		e.Trace = s.continueTrace(e.Trace)
+		unseen = append(unseen, e)
+	}
+
+	if err := s.persist(walRecord{Entries: unseen}); err != nil {
+		return nil, err
+	}
+
+	for i, e := range unseen {
+		s.addEntry(e)
+		s.traceHop(name, peerID, e, received[i])
+	}
+
+	return unseen, nil
+}
+
+// addEntry stores an entry and, in causal mode, hands it over for delivery.
+// Must be called with s.mu held.
+func (s *Server) addEntry(e Entry) bool {
+	if !s.entries.Add(e) {
+		return false
+	}
+
+	switch s.mode {
+	case ModeCausal:
+		s.causal.Add(e)
+	case ModeTotal:
+		s.sequencer.Offer(e)
+	}
 
-	for _, m := range body.Messages {
-		if _, exists := s.messages[m]; !exists {
-			unseenMessages = append(unseenMessages, m)
-			s.messages[m] = struct{}{}
+	return true
+}
+
+func (s *Server) broadcastMessageToPeer(peerID string, body BroadcastInternalMessage) {
+	err := s.retrier.Do(context.Background(), peerID, func(ctx context.Context) error {
+		// No point in hammering a peer the failure detector considers dead. The
+		// wait is bounded like a call, so it counts against the retry limits.
+		waitCtx, stopWaiting := context.WithTimeout(ctx, s.cfg.RPC.Timeout.Duration())
+		alive, waitErr := s.detector.WaitAlive(waitCtx, peerID)
+		stopWaiting()
+		if waitErr != nil {
+			return fmt.Errorf("node %s is down: %w", peerID, waitErr)
+		}
+		if !alive {
+			return retry.Permanent(fmt.Errorf("node %s left the cluster", peerID))
 		}
+
+		ctx, cancel := context.WithTimeout(ctx, s.cfg.RPC.Timeout.Duration())
+		defer cancel()
+
+		_, err := s.node.SyncRPC(ctx, peerID, body)
+		return err
+	})
+
+	if err != nil {
+		log.Printf("Giving up on forwarding to node %s: %v", peerID, err)
 	}
+}
 
-	if len(unseenMessages) == 0 {
-		broadcastInternalMessageResponse := BroadcastInternalMessageResponse{
-			Type: "broadcast_internal_ok",
+// Must be called with s.mu held
+func (s *Server) reroute(previous map[string][]string) {
+	targets := s.topology[s.nodeID]
+	if len(targets) == 0 {
+		// A leaf hands them to the root, which forwards to the whole tree, the
+		// same way its own broadcasts go
+		if s.masterNode != s.nodeID && s.detector.Alive(s.masterNode) {
+			targets = []string{s.masterNode}
+		} else {
+			targets = s.detector.AliveMembers()
 		}
+	}
 
-		return s.node.Reply(msg, broadcastInternalMessageResponse)
+	for _, peerID := range previous[s.nodeID] {
+		if slices.Contains(targets, peerID) || peerID == s.masterNode || len(targets) == 0 {
+			continue
+		}
+
+		entries := s.batcher.Take(peerID)
+		if len(entries) == 0 {
+			continue
+		}
+
+		log.Printf("Rerouting %d entries pending for node %s to %v", len(entries), peerID, targets)
+		for _, targetID := range targets {
+			for _, entry := range entries {
+				s.batcher.Add(targetID, entry)
+			}
+		}
 	}
 
-	for _, m := range unseenMessages {
-		for _, peerID := range s.topology[s.nodeID] {
-			s.batcher.Add(peerID, m)
+	before := neighbors(previous, s.nodeID)
+	for _, peerID := range neighbors(s.topology, s.nodeID) {
+		if !slices.Contains(before, peerID) {
+			go s.syncWith(peerID)
 		}
 	}
+}
 
-	broadcastInternalMessageResponse := BroadcastInternalMessageResponse{
-		Type: "broadcast_internal_ok",
+// Anti-entropy: periodically pull whatever a random alive peer has and our vector does not cover
+func (s *Server) antiEntropy() {
+	for range s.antiEntropyTicker.C {
+		peers := s.detector.AliveMembers()
+		if len(peers) == 0 {
+			continue
+		}
+
+		s.syncWith(peers[rand.Intn(len(peers))])
 	}
+}
 
-	return s.node.Reply(msg, broadcastInternalMessageResponse)
+func (s *Server) syncWith(peerID string) {
+	added, err := s.pull(peerID)
+	if err != nil {
+		log.Printf("Failed to sync with node: %s", peerID)
+	}
+
+	if added > 0 {
+		log.Printf("Anti-entropy with %s recovered %d entries", peerID, added)
+	}
 }
 
-func broadcastMessageToPeer(node *maelstrom.Node, peerID string, body BroadcastInternalMessage) {
-	backoff := time.Millisecond
+// pull copies what the peer has and our vector does not cover, one page per
+// round trip. The vector we ask with moves past every page, not just past what
+// we could add, so a gap on the peer's side does not make it send the same
+// page forever.
+func (s *Server) pull(peerID string) (int, error) {
+	s.mu.Lock()
+	vector := s.entries.Vector()
+	s.mu.Unlock()
+
+	added := 0
 	for {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		_, err := node.SyncRPC(ctx, peerID, body)
+		syncMessage := SyncMessage{
+			Type:   "sync",
+			Vector: vector,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.RPC.Timeout.Duration())
+		resp, err := s.node.SyncRPC(ctx, peerID, syncMessage)
 		cancel()
+		if err != nil {
+			return added, err
+		}
+
+		var body SyncMessageResponse
+		if err := json.Unmarshal(resp.Body, &body); err != nil {
+			return added, err
+		}
 
-		if err == nil {
-			return
+		s.mu.Lock()
+		unseen, err := s.acceptEntries("sync", peerID, body.Entries)
+		s.mu.Unlock()
+		if err != nil {
+			return added, err
 		}
+		added += len(unseen)
 
-		time.Sleep(backoff + time.Duration(rand.Intn(50))*time.Millisecond)
-		if backoff < 500*time.Millisecond {
-			backoff *= 2
+		if !body.More {
+			return added, nil
 		}
+
+		for _, e := range body.Entries {
+			vector[e.Origin] = max(vector[e.Origin], e.Seq)
+		}
+	}
+}
+
+func (s *Server) syncHandler(msg maelstrom.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var body SyncMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
+
+	entries, more := s.entries.Page(body.Vector, maxEntriesPerMessage)
+	syncMessageResponse := SyncMessageResponse{
+		Type:    "sync_ok",
+		Entries: entries,
+		More:    more,
+	}
+
+	return s.node.Reply(msg, syncMessageResponse)
 }
 
 func (s *Server) noOpHandler(maelstrom.Message) error {
@@ -204,15 +558,20 @@ func (s *Server) noOpHandler(maelstrom.Message) error {
 func (s *Server) readHandler(msg maelstrom.Message) error {
 	var body ReadMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	messages := make([]int, 0, len(s.messages))
-	for m := range s.messages {
-		messages = append(messages, m)
+	var messages []int
+	switch s.mode {
+	case ModeCausal:
+		messages = s.causal.Values()
+	case ModeTotal:
+		messages = s.sequencer.Values()
+	default:
+		messages = s.entries.Values()
 	}
 
 	readMessageResponse := ReadMessageResponse{
@@ -229,33 +588,58 @@ func (s *Server) topologyHandler(msg maelstrom.Message) error {
 
 	var body TopologyMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
-	// We ignore topology sent from maelstrom's controller, at least for now
 	topologyMessageResponse := TopologyMessageResponse{
 		Type: "topology_ok",
 	}
 
 	log.Printf("Received topology information from controller: %v", body.Topology)
 
-	s.topology = topology
-	s.masterNode = masterNode
+	if err := s.persist(walRecord{Topology: body.Topology}); err != nil {
+		return err
+	}
+
+	s.useTopology(body.Topology)
+
+	return s.node.Reply(msg, topologyMessageResponse)
+}
+
+// Must be called with s.mu held. May swap a topology that is already in use:
+// entries batched for children we lost go to the new children instead, or to the
+// root when we became a leaf, and new neighbors are synced with right away instead
+// of at the next anti-entropy round.
+func (s *Server) useTopology(topology map[string][]string) {
+	previous := s.topology
+
+	s.masterNode = treeRoot(topology, s.cfg.Broadcast.MasterNode)
+	s.topology = rootedAt(topology, s.masterNode)
+
+	if previous != nil {
+		s.reroute(previous)
+	}
 
 	log.Printf("Using topology: %v, central node: %s", s.topology, s.masterNode)
 
-	if s.nodeID == masterNode {
+	if s.nodeID == s.masterNode {
 		s.role = "LEADER"
 	} else {
 		s.role = "FOLLOWER"
 	}
-
-	return s.node.Reply(msg, topologyMessageResponse)
 }
 
 func (s *Server) Run() error {
 	go s.handleFlushes()
 	go s.batcher.Run()
+	go s.detector.Run()
+	go s.antiEntropy()
+	go s.snapshots()
+	go s.membershipChanges(s.memberEvents)
+
+	if s.mode == ModeTotal {
+		go s.sequencer.Run()
+	}
 
 	return s.node.Run()
 }
@@ -264,4 +648,21 @@ func (s *Server) Close() {
 	log.Printf("Closing server")
 
 	s.batcher.Close()
+	s.detector.Close()
+	s.antiEntropyTicker.Stop()
+	s.snapshotTicker.Stop()
+	s.tracer.Close()
+
+	if s.mode == ModeTotal {
+		s.sequencer.Close()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.store != nil {
+		if err := s.store.Close(); err != nil {
+			log.Printf("Failed to close store: %v", err)
+		}
+	}
 }
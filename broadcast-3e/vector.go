@@ -0,0 +1,144 @@
+package main
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/trace"
+)
+
+// Node input lines are limited to 64KB. An entry with the deps of 25 nodes and
+// a trace context takes about 530 bytes, so a message carries at most this many.
+const maxEntriesPerMessage = 64
+
+// Entry is a single client broadcast, tagged by the node which received it.
+// Two clients broadcasting the same value produce two different entries.
+type Entry struct {
+	Origin string `json:"origin"`
+	Seq    uint64 `json:"seq"`
+	Value  int    `json:"value"`
+	// Only set in causal mode: what the origin had delivered when it received the entry
+	Deps VersionVector `json:"deps,omitempty"`
+	// Only set when tracing: where the entry is on its way through the cluster
+	Trace trace.Context `json:"trace,omitzero"`
+}
+
+// VersionVector maps an origin node to the highest sequence number up to which
+// we have seen every entry from that origin
+type VersionVector map[string]uint64
+
+type EntryLog struct {
+	entries map[string]map[uint64]Entry
+	vector  VersionVector
+	count   int
+}
+
+func NewEntryLog() *EntryLog {
+	return &EntryLog{
+		entries: make(map[string]map[uint64]Entry),
+		vector:  make(VersionVector),
+	}
+}
+
+// Add stores the entry and returns false if it has been seen already
+func (l *EntryLog) Add(e Entry) bool {
+	if l.Contains(e) {
+		return false
+	}
+
+	byOrigin, ok := l.entries[e.Origin]
+	if !ok {
+		byOrigin = make(map[uint64]Entry)
+		l.entries[e.Origin] = byOrigin
+	}
+
+	byOrigin[e.Seq] = e
+	l.count++
+
+	// Gossip may deliver entries out of order, the vector only covers the contiguous prefix
+	for {
+		if _, exists := byOrigin[l.vector[e.Origin]+1]; !exists {
+			break
+		}
+		l.vector[e.Origin]++
+	}
+
+	return true
+}
+
+func (l *EntryLog) Contains(e Entry) bool {
+	if e.Seq <= l.vector[e.Origin] {
+		return true
+	}
+
+	_, exists := l.entries[e.Origin][e.Seq]
+
+	return exists
+}
+
+// Vector returns a copy of the current version vector
+func (l *EntryLog) Vector() VersionVector {
+	vector := make(VersionVector, len(l.vector))
+	for origin, seq := range l.vector {
+		vector[origin] = seq
+	}
+
+	return vector
+}
+
+// Missing returns every entry not covered by the given version vector
+func (l *EntryLog) Missing(vector VersionVector) []Entry {
+	var missing []Entry
+	for origin, byOrigin := range l.entries {
+		for seq, e := range byOrigin {
+			if seq > vector[origin] {
+				missing = append(missing, e)
+			}
+		}
+	}
+
+	return missing
+}
+
+// Page returns at most limit of the entries not covered by the given vector,
+// lowest sequence numbers of each origin first, and whether more are left.
+// Every entry of an origin up to the last one returned is in the page, so a
+// caller moves its vector past them to ask for the next.
+func (l *EntryLog) Page(vector VersionVector, limit int) ([]Entry, bool) {
+	origins := slices.Sorted(maps.Keys(l.entries))
+
+	var page []Entry
+	for _, origin := range origins {
+		var seqs []uint64
+		for seq := range l.entries[origin] {
+			if seq > vector[origin] {
+				seqs = append(seqs, seq)
+			}
+		}
+		slices.Sort(seqs)
+
+		for _, seq := range seqs {
+			if len(page) == limit {
+				return page, true
+			}
+			page = append(page, l.entries[origin][seq])
+		}
+	}
+
+	return page, false
+}
+
+func (l *EntryLog) Values() []int {
+	values := make([]int, 0, l.count)
+	for _, byOrigin := range l.entries {
+		for _, e := range byOrigin {
+			values = append(values, e.Value)
+		}
+	}
+
+	return values
+}
+
+func (l *EntryLog) Len() int {
+	return l.count
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+// How many of the most recent samples per peer the percentiles are computed over
+const rttWindow = 100
+
+// LinkStats summarizes the round trip times of a single link, in milliseconds
+type LinkStats struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+	Max     float64 `json:"max"`
+}
+
+// RTTTracker keeps a sliding window of round trip times per peer
+type RTTTracker struct {
+	samples map[string][]time.Duration
+	next    map[string]int
+}
+
+func NewRTTTracker() *RTTTracker {
+	return &RTTTracker{
+		samples: make(map[string][]time.Duration),
+		next:    make(map[string]int),
+	}
+}
+
+func (t *RTTTracker) Record(peerID string, rtt time.Duration) {
+	samples := t.samples[peerID]
+	if len(samples) < rttWindow {
+		t.samples[peerID] = append(samples, rtt)
+		return
+	}
+
+	samples[t.next[peerID]] = rtt
+	t.next[peerID] = (t.next[peerID] + 1) % rttWindow
+}
+
+// Row returns the stats of every link starting at this node
+func (t *RTTTracker) Row() map[string]LinkStats {
+	row := make(map[string]LinkStats, len(t.samples))
+	for peerID, samples := range t.samples {
+		sorted := slices.Clone(samples)
+		slices.Sort(sorted)
+
+		row[peerID] = LinkStats{
+			Samples: len(sorted),
+			P50:     percentile(sorted, 0.50),
+			P90:     percentile(sorted, 0.90),
+			P99:     percentile(sorted, 0.99),
+			Max:     millis(sorted[len(sorted)-1]),
+		}
+	}
+
+	return row
+}
+
+func percentile(sorted []time.Duration, p float64) float64 {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+
+	return millis(sorted[max(i, 0)])
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"sync"
+	"time"
 
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/config"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
 type Server struct {
-	node   *maelstrom.Node
-	nodeID string
+	node      *maelstrom.Node
+	nodeID    string
+	startedAt time.Time
+	cfg       config.Config
+	peers     []string
+
+	mu     sync.Mutex
+	rtt    *RTTTracker
+	matrix map[string]map[string]LinkStats
+
+	pingTicker *time.Ticker
 }
 
 type EchoMessage struct {
@@ -24,11 +37,42 @@ type EchoMessageResponse struct {
 	Echo  string `json:"echo"`
 }
 
-func NewServer(n *maelstrom.Node) *Server {
-	s := &Server{node: n}
+type RTTPingMessage struct {
+	Type   string `json:"type"`
+	SentAt int64  `json:"sent_at"`
+	// The sender's own row of the matrix, so that every node learns all of it
+	Row map[string]LinkStats `json:"row,omitempty"`
+}
+
+type RTTPingMessageResponse struct {
+	Type   string `json:"type"`
+	SentAt int64  `json:"sent_at"`
+}
+
+type StatsMessage struct {
+	Type string `json:"type"`
+}
+
+type StatsMessageResponse struct {
+	Type   string                          `json:"type"`
+	Matrix map[string]map[string]LinkStats `json:"matrix"`
+}
+
+func NewServer(n *maelstrom.Node, cfg config.Config) *Server {
+	s := &Server{
+		node:       n,
+		startedAt:  time.Now(),
+		cfg:        cfg,
+		rtt:        NewRTTTracker(),
+		matrix:     make(map[string]map[string]LinkStats),
+		pingTicker: time.NewTicker(cfg.Echo.PingInterval.Duration()),
+	}
 
 	s.node.Handle("init", s.initHandler)
 	s.node.Handle("echo", s.echoHandler)
+	s.node.Handle("rtt_ping", s.rttPingHandler)
+	s.node.Handle("stats", s.statsHandler)
+	s.node.Handle("debug_state", s.debugStateHandler)
 
 	return s
 }
@@ -36,20 +80,29 @@ func NewServer(n *maelstrom.Node) *Server {
 func (s *Server) initHandler(msg maelstrom.Message) error {
 	var body maelstrom.InitMessageBody
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.nodeID = body.NodeID
 
 	log.Printf("Node id set to: %s", s.nodeID)
 
+	for _, peerID := range body.NodeIDs {
+		if peerID != s.nodeID {
+			s.peers = append(s.peers, peerID)
+		}
+	}
+
 	return nil
 }
 
 func (s *Server) echoHandler(msg maelstrom.Message) error {
 	var body EchoMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
 	echoMessageResponse := EchoMessageResponse{
@@ -61,6 +114,94 @@ func (s *Server) echoHandler(msg maelstrom.Message) error {
 	return s.node.Reply(msg, echoMessageResponse)
 }
 
+func (s *Server) pingPeers() {
+	for range s.pingTicker.C {
+		s.mu.Lock()
+		peers := s.peers
+		row := s.rtt.Row()
+		s.mu.Unlock()
+
+		for _, peerID := range peers {
+			go s.pingPeer(peerID, row)
+		}
+	}
+}
+
+func (s *Server) pingPeer(peerID string, row map[string]LinkStats) {
+	rttPingMessage := RTTPingMessage{
+		Type:   "rtt_ping",
+		SentAt: time.Now().UnixNano(),
+		Row:    row,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Echo.PingTimeout.Duration())
+	defer cancel()
+
+	resp, err := s.node.SyncRPC(ctx, peerID, rttPingMessage)
+	if err != nil {
+		log.Printf("Failed to ping node %s: %v", peerID, err)
+		return
+	}
+
+	var body RTTPingMessageResponse
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		log.Printf("Malformed ping reply from node %s: %v", peerID, err)
+		return
+	}
+
+	// The timestamp is ours, echoed back, so there is no clock skew involved
+	rtt := time.Since(time.Unix(0, body.SentAt))
+
+	s.mu.Lock()
+	s.rtt.Record(peerID, rtt)
+	s.mu.Unlock()
+}
+
+func (s *Server) rttPingHandler(msg maelstrom.Message) error {
+	var body RTTPingMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	s.mu.Lock()
+	if body.Row != nil {
+		s.matrix[msg.Src] = body.Row
+	}
+	s.mu.Unlock()
+
+	rttPingMessageResponse := RTTPingMessageResponse{
+		Type:   "rtt_ping_ok",
+		SentAt: body.SentAt,
+	}
+
+	return s.node.Reply(msg, rttPingMessageResponse)
+}
+
+func (s *Server) statsHandler(msg maelstrom.Message) error {
+	var body StatsMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matrix := make(map[string]map[string]LinkStats, len(s.matrix)+1)
+	for nodeID, row := range s.matrix {
+		matrix[nodeID] = row
+	}
+	matrix[s.nodeID] = s.rtt.Row()
+
+	statsMessageResponse := StatsMessageResponse{
+		Type:   "stats_ok",
+		Matrix: matrix,
+	}
+
+	return s.node.Reply(msg, statsMessageResponse)
+}
+
 func (s *Server) Run() error {
+	go s.pingPeers()
+
 	return s.node.Run()
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	laneWidth  = 120
+	gutter     = 70
+	headerSize = 40
+	footerSize = 20
+)
+
+// Colorblind friendly, replies share their request's color but are dashed
+var palette = []string{"#0072b2", "#e69f00", "#009e73", "#cc79a7", "#d55e00", "#56b4e9", "#f0e442", "#000000"}
+
+type Diagram struct {
+	arrows []*Arrow
+	lanes  []string
+	// Types without their _ok suffix, in the order of the legend
+	types []string
+	// Lanes with a recording, the others only show where their messages went
+	recorded map[string]bool
+
+	start time.Time
+	end   time.Time
+	scale time.Duration
+}
+
+func NewDiagram(arrows []*Arrow, scale time.Duration) *Diagram {
+	d := &Diagram{arrows: arrows, recorded: make(map[string]bool), scale: max(scale, time.Microsecond)}
+
+	seen := make(map[string]bool)
+	for _, a := range arrows {
+		for _, lane := range []string{a.From, a.To} {
+			if !seen[lane] {
+				seen[lane] = true
+				d.lanes = append(d.lanes, lane)
+			}
+		}
+		if !a.SentAt.IsZero() {
+			d.recorded[a.From] = true
+		}
+		if !a.ReceivedAt.IsZero() {
+			d.recorded[a.To] = true
+		}
+
+		if t := requestType(a.Type); !slices.Contains(d.types, t) {
+			d.types = append(d.types, t)
+		}
+
+		if d.start.IsZero() || a.Start().Before(d.start) {
+			d.start = a.Start()
+		}
+		if a.End().After(d.end) {
+			d.end = a.End()
+		}
+	}
+
+	slices.SortFunc(d.lanes, compareLanes)
+	slices.Sort(d.types)
+
+	return d
+}
+
+func requestType(t string) string {
+	return strings.TrimSuffix(t, "_ok")
+}
+
+// Nodes first in numeric order (n2 before n10), then clients and services
+func compareLanes(a, b string) int {
+	ai, aNode := nodeIndex(a)
+	bi, bNode := nodeIndex(b)
+	switch {
+	case aNode && bNode:
+		return cmp.Compare(ai, bi)
+	case aNode:
+		return -1
+	case bNode:
+		return 1
+	}
+
+	return strings.Compare(a, b)
+}
+
+func nodeIndex(lane string) (int, bool) {
+	if !strings.HasPrefix(lane, "n") {
+		return 0, false
+	}
+	i, err := strconv.Atoi(lane[1:])
+	return i, err == nil
+}
+
+func (d *Diagram) x(lane string) int {
+	return gutter + slices.Index(d.lanes, lane)*laneWidth + laneWidth/2
+}
+
+func (d *Diagram) y(t time.Time) float64 {
+	return headerSize + float64(t.Sub(d.start))/float64(d.scale)
+}
+
+func (d *Diagram) width() int {
+	return gutter + len(d.lanes)*laneWidth
+}
+
+func (d *Diagram) height() int {
+	return int(math.Ceil(d.y(d.end))) + footerSize
+}
+
+func (d *Diagram) color(t string) string {
+	return palette[slices.Index(d.types, requestType(t))%len(palette)]
+}
+
+func (d *Diagram) WriteSVG(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="12">`+"\n", d.width(), d.height())
+
+	bw.WriteString("<defs>\n")
+	for i, t := range d.types {
+		fmt.Fprintf(bw, `<marker id="head%d" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="6" markerHeight="6" orient="auto-start-reverse"><path d="M 0 0 L 10 5 L 0 10 z" fill="%s"/></marker>`+"\n", i, d.color(t))
+	}
+	bw.WriteString("</defs>\n")
+	bw.WriteString(`<rect width="100%" height="100%" fill="white"/>` + "\n")
+
+	d.writeTicks(bw)
+
+	for _, lane := range d.lanes {
+		x := d.x(lane)
+		dash := ""
+		if !d.recorded[lane] {
+			dash = ` stroke-dasharray="2 4"`
+		}
+		fmt.Fprintf(bw, `<text x="%d" y="%d" text-anchor="middle" font-weight="bold">%s</text>`+"\n", x, headerSize-15, html.EscapeString(lane))
+		fmt.Fprintf(bw, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999"%s/>`+"\n", x, headerSize-5, x, d.height()-footerSize/2, dash)
+	}
+
+	for _, a := range d.arrows {
+		d.writeArrow(bw, a)
+	}
+
+	bw.WriteString("</svg>\n")
+
+	return bw.Flush()
+}
+
+// writeTicks labels the time axis about every 100 pixels, on a 1, 2, 5 step
+func (d *Diagram) writeTicks(w io.Writer) {
+	step := niceStep(100 * d.scale)
+	for offset := time.Duration(0); d.start.Add(offset).Compare(d.end) <= 0; offset += step {
+		y := d.y(d.start.Add(offset))
+		fmt.Fprintf(w, `<text x="%d" y="%.1f" text-anchor="end" fill="#666">+%s</text>`+"\n", gutter-8, y+4, offset)
+		fmt.Fprintf(w, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#eee"/>`+"\n", gutter-4, y, d.width(), y)
+	}
+}
+
+func niceStep(d time.Duration) time.Duration {
+	step := time.Microsecond
+	for {
+		for _, m := range []time.Duration{1, 2, 5} {
+			if step*m >= d {
+				return step * m
+			}
+		}
+		step *= 10
+	}
+}
+
+func (d *Diagram) writeArrow(w io.Writer, a *Arrow) {
+	class := slices.Index(d.types, requestType(a.Type))
+	color := d.color(a.Type)
+
+	dash := ""
+	if strings.HasSuffix(a.Type, "_ok") {
+		dash = ` stroke-dasharray="5 3"`
+	}
+
+	sent, received := "?", "?"
+	if !a.SentAt.IsZero() {
+		sent = "+" + a.SentAt.Sub(d.start).String()
+	}
+	if !a.ReceivedAt.IsZero() {
+		received = "+" + a.ReceivedAt.Sub(d.start).String()
+	}
+	title := fmt.Sprintf("%s → %s %s\nsent %s, received %s\n%s", a.From, a.To, a.Type, sent, received, a.Body)
+
+	x1, y1 := d.x(a.From), d.y(a.Start())
+	x2, y2 := d.x(a.To), d.y(a.End())
+
+	fmt.Fprintf(w, `<g class="t%d"><title>%s</title>`, class, html.EscapeString(title))
+	fmt.Fprintf(w, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="%s" stroke-width="1.2"%s marker-end="url(#head%d)"/>`, x1, y1, x2, y2, color, dash, class)
+	// A message which never arrived ends in a cross
+	if a.ReceivedAt.IsZero() && d.recorded[a.To] {
+		fmt.Fprintf(w, `<text x="%d" y="%.1f" text-anchor="middle" fill="%s">✕</text>`, x2, y2+4, color)
+	}
+	w.Write([]byte("</g>\n"))
+}
+
+// WriteHTML wraps the SVG in a page with a legend whose checkboxes hide and
+// show message types
+func (d *Diagram) WriteHTML(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	bw.WriteString(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Lamport diagram</title>
+<style>
+body { font-family: monospace; margin: 0; }
+#legend { position: sticky; top: 0; background: #fafafa; border-bottom: 1px solid #ddd; padding: 8px; z-index: 1; }
+#legend label { margin-right: 16px; white-space: nowrap; }
+</style>
+</head>
+<body>
+<div id="legend">
+`)
+
+	counts := make(map[string]int)
+	for _, a := range d.arrows {
+		counts[requestType(a.Type)]++
+	}
+	for i, t := range d.types {
+		fmt.Fprintf(bw, `<label style="color: %s"><input type="checkbox" checked data-class="t%d"> %s (%d)</label>`+"\n", d.color(t), i, html.EscapeString(t), counts[t])
+	}
+
+	bw.WriteString(`</div>
+<script>
+document.querySelectorAll("#legend input").forEach(input => input.addEventListener("change", () => {
+	document.querySelectorAll("g." + input.dataset.class).forEach(g => g.style.display = input.checked ? "" : "none");
+}));
+</script>
+`)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	if err := d.WriteSVG(w); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "</body>\n</html>\n")
+
+	return err
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/replay"
+)
+
+// Event is one line of a recording: a message the node read or wrote
+type Event struct {
+	Time time.Time
+	Sent bool
+	Src  string
+	Dest string
+	Body json.RawMessage
+
+	header
+}
+
+type header struct {
+	Type      string `json:"type"`
+	MsgID     int64  `json:"msg_id"`
+	InReplyTo int64  `json:"in_reply_to"`
+}
+
+// Arrow is one message. Either end is unknown when the lane it touches was not
+// recorded, clients and lin-kv for example, or when the message was lost.
+type Arrow struct {
+	From, To   string
+	SentAt     time.Time
+	ReceivedAt time.Time
+	Type       string
+	Body       json.RawMessage
+}
+
+func (a Arrow) Start() time.Time {
+	if a.SentAt.IsZero() {
+		return a.ReceivedAt
+	}
+	return a.SentAt
+}
+
+func (a Arrow) End() time.Time {
+	if a.ReceivedAt.IsZero() {
+		return a.SentAt
+	}
+	return a.ReceivedAt
+}
+
+func LoadEvents(files []string) ([]Event, error) {
+	var events []Event
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+		for line := 1; scanner.Scan(); line++ {
+			var record replay.Record
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+			}
+			if record.Time.IsZero() {
+				f.Close()
+				return nil, fmt.Errorf("%s has no timestamps, it was recorded by an older build", file)
+			}
+
+			var msg struct {
+				Src  string          `json:"src"`
+				Dest string          `json:"dest"`
+				Body json.RawMessage `json:"body"`
+			}
+			if err := json.Unmarshal(record.Message, &msg); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+			}
+
+			e := Event{Time: record.Time, Sent: record.Sent, Src: msg.Src, Dest: msg.Dest, Body: msg.Body}
+			// Bodies that are not objects still get an arrow, just without a type
+			json.Unmarshal(msg.Body, &e.header)
+			events = append(events, e)
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	return events, nil
+}
+
+// Match pairs every write on one node with the read of the same message on the
+// other. Messages between two lanes keep their order on the wire, so equal
+// keys are paired first in, first out. Sends are collected before any receive
+// is paired, a receiver's read can be recorded before the sender's write.
+func Match(events []Event) []*Arrow {
+	type key struct {
+		src, dest        string
+		typ              string
+		msgID, inReplyTo int64
+	}
+
+	slices.SortStableFunc(events, func(a, b Event) int { return a.Time.Compare(b.Time) })
+
+	var arrows []*Arrow
+	pending := make(map[key][]*Arrow)
+
+	for _, e := range events {
+		if !e.Sent {
+			continue
+		}
+
+		a := &Arrow{From: e.Src, To: e.Dest, SentAt: e.Time, Type: e.Type, Body: e.Body}
+		k := key{e.Src, e.Dest, e.Type, e.MsgID, e.InReplyTo}
+		pending[k] = append(pending[k], a)
+		arrows = append(arrows, a)
+	}
+
+	for _, e := range events {
+		if e.Sent {
+			continue
+		}
+
+		k := key{e.Src, e.Dest, e.Type, e.MsgID, e.InReplyTo}
+		if queue := pending[k]; len(queue) > 0 {
+			queue[0].ReceivedAt = e.Time
+			pending[k] = queue[1:]
+			continue
+		}
+
+		arrows = append(arrows, &Arrow{From: e.Src, To: e.Dest, ReceivedAt: e.Time, Type: e.Type, Body: e.Body})
+	}
+
+	slices.SortStableFunc(arrows, func(a, b *Arrow) int { return a.Start().Compare(b.Start()) })
+
+	return arrows
+}
+
+type Filter struct {
+	Types []string
+	// nil keeps every message
+	Value    *int
+	Lanes    []string
+	From, To time.Duration
+}
+
+// Apply keeps the arrows passing every filter. Offsets count from the first
+// message of the whole run, not of the arrows that are left.
+func (f Filter) Apply(arrows []*Arrow) []*Arrow {
+	if len(arrows) == 0 {
+		return nil
+	}
+	start := arrows[0].Start()
+
+	var kept []*Arrow
+	for _, a := range arrows {
+		offset := a.Start().Sub(start)
+		if offset < f.From || (f.To > 0 && offset > f.To) {
+			continue
+		}
+		if len(f.Types) > 0 && !slices.Contains(f.Types, strings.TrimSuffix(a.Type, "_ok")) && !slices.Contains(f.Types, a.Type) {
+			continue
+		}
+		if len(f.Lanes) > 0 && !slices.Contains(f.Lanes, a.From) && !slices.Contains(f.Lanes, a.To) {
+			continue
+		}
+		if f.Value != nil && !carriesValue(a.Body, *f.Value) {
+			continue
+		}
+		kept = append(kept, a)
+	}
+
+	return kept
+}
+
+// carriesValue looks for the value wherever the broadcast modules put one:
+// message in broadcast, messages in read_ok and gossip, value in entries
+func carriesValue(body json.RawMessage, value int) bool {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return false
+	}
+
+	var walk func(v any) bool
+	walk = func(v any) bool {
+		switch x := v.(type) {
+		case map[string]any:
+			for k, child := range x {
+				if (k == "message" || k == "messages" || k == "value") && holds(child, value) {
+					return true
+				}
+				if walk(child) {
+					return true
+				}
+			}
+		case []any:
+			for _, child := range x {
+				if walk(child) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	return walk(v)
+}
+
+func holds(v any, value int) bool {
+	switch x := v.(type) {
+	case float64:
+		return x == float64(value)
+	case []any:
+		for _, item := range x {
+			if n, ok := item.(float64); ok && n == float64(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,3 @@
+module github.com/deamondev/gossip-glomers-tutorial/lamport
+
+go 1.25.4
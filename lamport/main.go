@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lamport draws a run recorded with RECORD_DIR as a space-time diagram: one
+// lane per node, client and service, time flowing down, an arrow per message.
+// It works for Maelstrom runs and for the in-process cluster of loadgen alike,
+// as long as the nodes were started with RECORD_DIR set.
+func main() {
+	log.SetOutput(os.Stderr)
+
+	dir := flag.String("dir", "", "directory with the <node id>.replay.jsonl recordings")
+	out := flag.String("o", "lamport.html", "output file, SVG when it ends in .svg and HTML otherwise")
+	types := flag.String("type", "", "comma separated message types to keep, a type also keeps its _ok replies")
+	value := flag.Int("value", 0, "only keep messages carrying this broadcast value")
+	nodes := flag.String("nodes", "", "comma separated lanes to keep, messages need one end in them")
+	from := flag.Duration("from", 0, "skip messages sent before this offset from the start of the run")
+	to := flag.Duration("to", 0, "skip messages sent after this offset, 0 means until the end")
+	scale := flag.Duration("scale", time.Millisecond, "time per pixel")
+	limit := flag.Int("limit", 5000, "maximum number of arrows, the earliest are kept")
+	flag.Parse()
+
+	if *dir == "" {
+		log.Fatal("-dir is required")
+	}
+
+	var filter Filter
+	if *types != "" {
+		filter.Types = strings.Split(*types, ",")
+	}
+	if *nodes != "" {
+		filter.Lanes = strings.Split(*nodes, ",")
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "value" {
+			filter.Value = value
+		}
+	})
+	filter.From, filter.To = *from, *to
+
+	files, err := filepath.Glob(filepath.Join(*dir, "*.replay.jsonl"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(files) == 0 {
+		log.Fatalf("No recordings in %s", *dir)
+	}
+
+	events, err := LoadEvents(files)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	arrows := Match(events)
+	kept := filter.Apply(arrows)
+	if len(kept) > *limit {
+		log.Printf("Keeping the first %d of %d arrows, narrow the filter or raise -limit to see the rest", *limit, len(kept))
+		kept = kept[:*limit]
+	}
+
+	d := NewDiagram(kept, *scale)
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(*out, ".svg") {
+		err = d.WriteSVG(f)
+	} else {
+		err = d.WriteHTML(f)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Drew %d of %d messages across %d lanes to %s", len(kept), len(arrows), len(d.lanes), *out)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/client"
+)
+
+const (
+	WorkloadEcho      = "echo"
+	WorkloadUniqueIDs = "unique-ids"
+	WorkloadBroadcast = "broadcast"
+
+	DistributionUniform = "uniform"
+	DistributionZipf    = "zipf"
+
+	TopologyGrid  = "grid"
+	TopologyLine  = "line"
+	TopologyTotal = "total"
+)
+
+type Config struct {
+	Binary       string
+	NodeCount    int
+	Workload     string
+	Rate         float64
+	Concurrency  int
+	Duration     time.Duration
+	Distribution string
+	Topology     string
+	Settle       time.Duration
+	LogDir       string
+}
+
+// Generator sends requests from a fixed number of workers, paced by a shared
+// rate limiter, and checks the results once the load stops
+type Generator struct {
+	client  *client.Client
+	nodeIDs []string
+	cfg     Config
+
+	pick func() string
+
+	nextValue atomic.Int64
+
+	mu     sync.Mutex
+	ids    map[string]struct{}
+	acked  []int
+	report *Report
+}
+
+func NewGenerator(c *client.Client, nodeIDs []string, cfg Config) (*Generator, error) {
+	g := &Generator{
+		client:  c,
+		nodeIDs: nodeIDs,
+		cfg:     cfg,
+		ids:     make(map[string]struct{}),
+		report:  NewReport(cfg.Workload),
+	}
+
+	switch cfg.Workload {
+	case WorkloadEcho, WorkloadUniqueIDs, WorkloadBroadcast:
+	default:
+		return nil, fmt.Errorf("unknown workload: %s", cfg.Workload)
+	}
+
+	switch cfg.Distribution {
+	case DistributionUniform:
+		g.pick = func() string { return nodeIDs[rand.Intn(len(nodeIDs))] }
+	case DistributionZipf:
+		// n0 gets the most traffic, every next node noticeably less
+		var mu sync.Mutex
+		zipf := rand.NewZipf(rand.New(rand.NewSource(time.Now().UnixNano())), 1.1, 1, uint64(len(nodeIDs)-1))
+		g.pick = func() string {
+			mu.Lock()
+			defer mu.Unlock()
+			return nodeIDs[zipf.Uint64()]
+		}
+	default:
+		return nil, fmt.Errorf("unknown distribution: %s", cfg.Distribution)
+	}
+
+	return g, nil
+}
+
+func (g *Generator) Run() (*Report, error) {
+	if g.cfg.Workload == WorkloadBroadcast {
+		if err := g.sendTopology(); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.cfg.Duration)
+	defer cancel()
+
+	tokens := g.limiter(ctx)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range g.cfg.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range tokens {
+				g.request()
+			}
+		}()
+	}
+	wg.Wait()
+	g.report.Elapsed = time.Since(start)
+
+	if g.cfg.Workload == WorkloadBroadcast {
+		log.Printf("Waiting %s for broadcasts to converge", g.cfg.Settle)
+		time.Sleep(g.cfg.Settle)
+		g.checkBroadcasts()
+	}
+
+	return g.report, nil
+}
+
+// limiter hands out one token per request until ctx is done. Tokens are
+// scheduled against the start time rather than a ticker, so a worker that
+// falls behind is allowed to catch up and the average rate holds.
+func (g *Generator) limiter(ctx context.Context) <-chan struct{} {
+	tokens := make(chan struct{})
+
+	go func() {
+		defer close(tokens)
+
+		start := time.Now()
+		for i := 0; ; i++ {
+			if g.cfg.Rate > 0 {
+				due := start.Add(time.Duration(float64(i) / g.cfg.Rate * float64(time.Second)))
+				if wait := time.Until(due); wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return tokens
+}
+
+func (g *Generator) request() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dest := g.pick()
+	start := time.Now()
+
+	var err error
+	switch g.cfg.Workload {
+	case WorkloadEcho:
+		payload := strconv.Itoa(rand.Int())
+		var echo string
+		if echo, err = g.client.Echo(ctx, dest, payload); err == nil && echo != payload {
+			err = fmt.Errorf("echo mismatch: sent %q, got %q", payload, echo)
+		}
+	case WorkloadUniqueIDs:
+		var id string
+		if id, err = g.client.Generate(ctx, dest); err == nil {
+			g.mu.Lock()
+			if _, exists := g.ids[id]; exists {
+				g.report.Duplicates++
+			}
+			g.ids[id] = struct{}{}
+			g.mu.Unlock()
+		}
+	case WorkloadBroadcast:
+		value := int(g.nextValue.Add(1))
+		if err = g.client.Broadcast(ctx, dest, value); err == nil {
+			g.mu.Lock()
+			g.acked = append(g.acked, value)
+			g.mu.Unlock()
+		}
+	}
+
+	g.report.Record(time.Since(start), err)
+}
+
+func (g *Generator) sendTopology() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	topology := buildTopology(g.cfg.Topology, g.nodeIDs)
+	for _, nodeID := range g.nodeIDs {
+		if err := g.client.Topology(ctx, nodeID, topology); err != nil {
+			return fmt.Errorf("send topology to %s: %w", nodeID, err)
+		}
+	}
+
+	return nil
+}
+
+// checkBroadcasts reads every node and counts acknowledged values it is missing
+func (g *Generator) checkBroadcasts() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, nodeID := range g.nodeIDs {
+		messages, err := g.client.Read(ctx, nodeID)
+		if err != nil {
+			log.Printf("Final read from %s failed: %v", nodeID, err)
+			g.report.Lost[nodeID] = len(g.acked)
+			continue
+		}
+
+		seen := make(map[int]struct{}, len(messages))
+		for _, m := range messages {
+			seen[m] = struct{}{}
+		}
+
+		for _, value := range g.acked {
+			if _, ok := seen[value]; !ok {
+				g.report.Lost[nodeID]++
+			}
+		}
+	}
+}
+
+func buildTopology(kind string, nodeIDs []string) map[string][]string {
+	topology := make(map[string][]string, len(nodeIDs))
+
+	switch kind {
+	case TopologyLine:
+		for i, nodeID := range nodeIDs {
+			topology[nodeID] = []string{}
+			if i > 0 {
+				topology[nodeID] = append(topology[nodeID], nodeIDs[i-1])
+			}
+			if i < len(nodeIDs)-1 {
+				topology[nodeID] = append(topology[nodeID], nodeIDs[i+1])
+			}
+		}
+	case TopologyTotal:
+		for _, nodeID := range nodeIDs {
+			for _, peerID := range nodeIDs {
+				if peerID != nodeID {
+					topology[nodeID] = append(topology[nodeID], peerID)
+				}
+			}
+		}
+	default:
+		// Same shape as Maelstrom's grid: nodes laid out row by row in a square
+		side := 1
+		for side*side < len(nodeIDs) {
+			side++
+		}
+
+		for i, nodeID := range nodeIDs {
+			topology[nodeID] = []string{}
+			row, col := i/side, i%side
+			for _, d := range [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+				r, c := row+d[0], col+d[1]
+				j := r*side + c
+				if r >= 0 && c >= 0 && c < side && j < len(nodeIDs) {
+					topology[nodeID] = append(topology[nodeID], nodeIDs[j])
+				}
+			}
+		}
+	}
+
+	return topology
+}
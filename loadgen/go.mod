@@ -0,0 +1,5 @@
+module github.com/deamondev/gossip-glomers-tutorial/loadgen
+
+go 1.25.4
+
+require github.com/jepsen-io/maelstrom/demo/go v0.0.0-20250920002117-21168aa9cdd2
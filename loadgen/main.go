@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/client"
+)
+
+func main() {
+	log.SetOutput(os.Stderr)
+
+	var cfg Config
+	flag.StringVar(&cfg.Binary, "bin", "", "node binary to spawn")
+	flag.IntVar(&cfg.NodeCount, "node-count", 5, "number of nodes")
+	flag.StringVar(&cfg.Workload, "workload", WorkloadBroadcast, "echo, unique-ids or broadcast")
+	flag.Float64Var(&cfg.Rate, "rate", 1000, "requests per second across all workers, 0 means as fast as possible")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 16, "number of requests in flight at once")
+	flag.DurationVar(&cfg.Duration, "time-limit", 10*time.Second, "how long to generate load")
+	flag.StringVar(&cfg.Distribution, "distribution", DistributionUniform, "how requests are spread over nodes: uniform or zipf")
+	flag.StringVar(&cfg.Topology, "topology", TopologyGrid, "broadcast topology: grid, line or total")
+	flag.DurationVar(&cfg.Settle, "settle", 5*time.Second, "how long to wait for broadcasts to converge before the final reads")
+	flag.StringVar(&cfg.LogDir, "log-dir", "", "directory for node stderr, discarded when empty")
+	flag.Parse()
+
+	if cfg.Binary == "" {
+		log.Fatal("-bin is required")
+	}
+
+	cluster, err := client.Spawn(cfg.Binary, cfg.NodeCount, cfg.LogDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c := client.New(cluster, "c1")
+	defer c.Close()
+
+	g, err := NewGenerator(c, cluster.NodeIDs(), cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	report, err := g.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	report.Print(os.Stdout)
+
+	if !report.Valid() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+type Report struct {
+	Workload string
+	Elapsed  time.Duration
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    map[string]int
+
+	// unique-ids: IDs handed out more than once
+	Duplicates int
+	// broadcast: acknowledged values missing from each node's final read
+	Lost map[string]int
+}
+
+func NewReport(workload string) *Report {
+	return &Report{
+		Workload: workload,
+		errors:   make(map[string]int),
+		Lost:     make(map[string]int),
+	}
+}
+
+func (r *Report) Record(latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		kind := err.Error()
+		if code := maelstrom.ErrorCode(err); code >= 0 {
+			kind = maelstrom.ErrorCodeText(code)
+		}
+		r.errors[kind]++
+		return
+	}
+
+	r.latencies = append(r.latencies, latency)
+}
+
+// Valid reports whether the run passed the workload's checks
+func (r *Report) Valid() bool {
+	if r.Duplicates > 0 {
+		return false
+	}
+
+	for _, lost := range r.Lost {
+		if lost > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *Report) Print(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	failed := 0
+	for _, count := range r.errors {
+		failed += count
+	}
+	total := len(r.latencies) + failed
+
+	fmt.Fprintf(w, "workload:    %s\n", r.Workload)
+	fmt.Fprintf(w, "requests:    %d ok, %d failed in %s\n", len(r.latencies), failed, r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "throughput:  %.1f req/s\n", float64(total)/r.Elapsed.Seconds())
+
+	if len(r.latencies) > 0 {
+		slices.Sort(r.latencies)
+		fmt.Fprintf(w, "latency:     p50 %s, p90 %s, p99 %s, max %s\n",
+			r.percentile(0.5), r.percentile(0.9), r.percentile(0.99), r.latencies[len(r.latencies)-1])
+	}
+
+	kinds := make([]string, 0, len(r.errors))
+	for kind := range r.errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "error:       %s x%d\n", kind, r.errors[kind])
+	}
+
+	if r.Workload == WorkloadUniqueIDs {
+		fmt.Fprintf(w, "duplicates:  %d\n", r.Duplicates)
+	}
+
+	if r.Workload == WorkloadBroadcast {
+		nodeIDs := make([]string, 0, len(r.Lost))
+		for nodeID := range r.Lost {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+		sort.Strings(nodeIDs)
+
+		lost := 0
+		for _, nodeID := range nodeIDs {
+			if r.Lost[nodeID] == 0 {
+				continue
+			}
+			lost += r.Lost[nodeID]
+			fmt.Fprintf(w, "lost:        %s missing %d values\n", nodeID, r.Lost[nodeID])
+		}
+		if lost == 0 {
+			fmt.Fprintf(w, "lost:        none, every node has every acknowledged value\n")
+		}
+	}
+}
+
+func (r *Report) percentile(p float64) time.Duration {
+	return r.latencies[int(p*float64(len(r.latencies)-1))].Round(time.Microsecond)
+}
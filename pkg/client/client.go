@@ -0,0 +1,217 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Client issues Maelstrom client requests (echo, generate, broadcast, read,
+// topology, debug_state) and matches replies by msg_id. It is safe for
+// concurrent use, any number of requests may be in flight at once.
+type Client struct {
+	id        string
+	transport Transport
+
+	mu        sync.Mutex
+	nextMsgID int
+	pending   map[int]chan Message
+	closed    bool
+}
+
+type replyBody struct {
+	Type      string `json:"type"`
+	InReplyTo int    `json:"in_reply_to"`
+	Code      int    `json:"code"`
+	Text      string `json:"text"`
+}
+
+func New(t Transport, id string) *Client {
+	c := &Client{
+		id:        id,
+		transport: t,
+		pending:   make(map[int]chan Message),
+	}
+
+	go c.receive()
+
+	return c
+}
+
+func (c *Client) ID() string {
+	return c.id
+}
+
+// RPC sends body to dest and waits for the reply. Error replies are returned
+// as *maelstrom.RPCError.
+func (c *Client) RPC(ctx context.Context, dest string, body any) (json.RawMessage, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Numbers stay json.Number, a float64 would round 64-bit IDs
+	var fields map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	c.nextMsgID++
+	msgID := c.nextMsgID
+	ch := make(chan Message, 1)
+	c.pending[msgID] = ch
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, msgID)
+		c.mu.Unlock()
+	}()
+
+	fields["msg_id"] = msgID
+	if raw, err = json.Marshal(fields); err != nil {
+		return nil, err
+	}
+
+	if err := c.transport.Send(Message{Src: c.id, Dest: dest, Body: raw}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return nil, ErrClosed
+		}
+
+		var reply replyBody
+		if err := json.Unmarshal(msg.Body, &reply); err != nil {
+			return nil, err
+		}
+		if reply.Type == "error" {
+			return nil, maelstrom.NewRPCError(reply.Code, reply.Text)
+		}
+
+		return msg.Body, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) Echo(ctx context.Context, dest, echo string) (string, error) {
+	raw, err := c.RPC(ctx, dest, map[string]any{"type": "echo", "echo": echo})
+	if err != nil {
+		return "", err
+	}
+
+	var body struct {
+		Echo string `json:"echo"`
+	}
+	err = json.Unmarshal(raw, &body)
+
+	return body.Echo, err
+}
+
+// Generate returns the ID as its JSON text, so numeric IDs keep every digit
+func (c *Client) Generate(ctx context.Context, dest string) (string, error) {
+	raw, err := c.RPC(ctx, dest, map[string]any{"type": "generate"})
+	if err != nil {
+		return "", err
+	}
+
+	var body struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return "", err
+	}
+	if len(body.ID) == 0 {
+		return "", fmt.Errorf("generate_ok without an id: %s", raw)
+	}
+
+	return strings.Trim(string(body.ID), `"`), nil
+}
+
+func (c *Client) Broadcast(ctx context.Context, dest string, message int) error {
+	_, err := c.RPC(ctx, dest, map[string]any{"type": "broadcast", "message": message})
+
+	return err
+}
+
+func (c *Client) Read(ctx context.Context, dest string) ([]int, error) {
+	raw, err := c.RPC(ctx, dest, map[string]any{"type": "read"})
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		Messages []int `json:"messages"`
+	}
+	err = json.Unmarshal(raw, &body)
+
+	return body.Messages, err
+}
+
+func (c *Client) Topology(ctx context.Context, dest string, topology map[string][]string) error {
+	_, err := c.RPC(ctx, dest, map[string]any{"type": "topology", "topology": topology})
+
+	return err
+}
+
+// DebugState returns the raw debug_state_ok body, its fields depend on the module
+func (c *Client) DebugState(ctx context.Context, dest string) (json.RawMessage, error) {
+	return c.RPC(ctx, dest, map[string]any{"type": "debug_state"})
+}
+
+func (c *Client) Close() error {
+	return c.transport.Close()
+}
+
+func (c *Client) receive() {
+	for {
+		msg, err := c.transport.Recv()
+		if err != nil {
+			c.mu.Lock()
+			c.closed = true
+			for msgID, ch := range c.pending {
+				close(ch)
+				delete(c.pending, msgID)
+			}
+			c.mu.Unlock()
+			return
+		}
+
+		// Message ids are only unique per sender, a reply meant for another
+		// client or a node can carry one of ours
+		if msg.Dest != c.id {
+			continue
+		}
+
+		var reply replyBody
+		if err := json.Unmarshal(msg.Body, &reply); err != nil {
+			log.Printf("Dropping undecodable reply from %s: %v", msg.Src, err)
+			continue
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[reply.InReplyTo]
+		delete(c.pending, reply.InReplyTo)
+		c.mu.Unlock()
+
+		if ok {
+			ch <- msg
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster runs node binaries as local processes and routes messages between
+// them the way Maelstrom does, minus the latency and fault injection. Messages
+// for lin-kv are answered by an in-memory store, anything addressed to a
+// client is handed out through Recv.
+type Cluster struct {
+	nodeIDs []string
+	nodes   map[string]*process
+	kv      *linKV
+
+	inbox chan Message
+	done  chan struct{}
+	once  sync.Once
+
+	unknown sync.Map
+}
+
+type process struct {
+	cmd *exec.Cmd
+	log *os.File
+
+	mu    sync.Mutex
+	stdin io.WriteCloser
+}
+
+// Spawn starts nodeCount copies of binary and initializes them. Node stderr
+// goes to logDir/<node id>.log, or nowhere when logDir is empty.
+func Spawn(binary string, nodeCount int, logDir string) (*Cluster, error) {
+	c := &Cluster{
+		nodes: make(map[string]*process),
+		kv:    newLinKV(),
+		inbox: make(chan Message, 4096),
+		done:  make(chan struct{}),
+	}
+
+	for i := range nodeCount {
+		c.nodeIDs = append(c.nodeIDs, fmt.Sprintf("n%d", i))
+	}
+
+	for _, nodeID := range c.nodeIDs {
+		if err := c.start(binary, nodeID, logDir); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if err := c.init(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Cluster) NodeIDs() []string {
+	return c.nodeIDs
+}
+
+func (c *Cluster) Send(msg Message) error {
+	p, ok := c.nodes[msg.Dest]
+	if !ok {
+		return fmt.Errorf("unknown node %s", msg.Dest)
+	}
+
+	return p.send(msg)
+}
+
+func (c *Cluster) Recv() (Message, error) {
+	select {
+	case msg := <-c.inbox:
+		return msg, nil
+	case <-c.done:
+		return Message{}, ErrClosed
+	}
+}
+
+// Close stops every node: stdin is closed first so nodes can shut down cleanly
+func (c *Cluster) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+
+		for _, p := range c.nodes {
+			p.stdin.Close()
+		}
+
+		var wg sync.WaitGroup
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		for _, p := range c.nodes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				waited := make(chan struct{})
+				go func() {
+					p.cmd.Wait()
+					close(waited)
+				}()
+
+				select {
+				case <-waited:
+				case <-ctx.Done():
+					p.cmd.Process.Kill()
+					<-waited
+				}
+
+				if p.log != nil {
+					p.log.Close()
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	return nil
+}
+
+func (c *Cluster) start(binary, nodeID, logDir string) error {
+	cmd := exec.Command(binary)
+	p := &process{cmd: cmd}
+
+	if logDir != "" {
+		if err := os.MkdirAll(logDir, 0o755); err != nil {
+			return err
+		}
+		f, err := os.Create(filepath.Join(logDir, nodeID+".log"))
+		if err != nil {
+			return err
+		}
+		cmd.Stderr = f
+		p.log = f
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	p.stdin = stdin
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %s: %w", nodeID, err)
+	}
+
+	c.nodes[nodeID] = p
+
+	go c.route(nodeID, stdout)
+
+	return nil
+}
+
+// init sends every node its init message and waits for all of them to
+// answer, Maelstrom does the same before any client request goes out
+func (c *Cluster) init() error {
+	for i, nodeID := range c.nodeIDs {
+		body, _ := json.Marshal(map[string]any{"type": "init", "msg_id": i + 1, "node_id": nodeID, "node_ids": c.nodeIDs})
+		if err := c.Send(Message{Src: "c0", Dest: nodeID, Body: body}); err != nil {
+			return fmt.Errorf("init %s: %w", nodeID, err)
+		}
+	}
+
+	timeout := time.After(10 * time.Second)
+	for range c.nodeIDs {
+		select {
+		case msg := <-c.inbox:
+			var reply replyBody
+			if err := json.Unmarshal(msg.Body, &reply); err != nil {
+				return err
+			}
+			if reply.Type != "init_ok" {
+				return fmt.Errorf("init %s: unexpected reply %s", msg.Src, msg.Body)
+			}
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for init_ok")
+		}
+	}
+
+	return nil
+}
+
+func (c *Cluster) route(nodeID string, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for scanner.Scan() {
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Printf("Dropping undecodable message from %s: %v", nodeID, err)
+			continue
+		}
+
+		switch {
+		case msg.Dest == "lin-kv":
+			reply := c.kv.handle(msg)
+			c.nodes[nodeID].send(reply)
+		case c.nodes[msg.Dest] != nil:
+			// A node which already exited just loses the message, like it would in Maelstrom
+			c.nodes[msg.Dest].send(msg)
+		case strings.HasPrefix(msg.Dest, "c"):
+			select {
+			case c.inbox <- msg:
+			case <-c.done:
+				return
+			}
+		default:
+			if _, logged := c.unknown.LoadOrStore(msg.Dest, struct{}{}); !logged {
+				log.Printf("Dropping messages to unknown destination %s", msg.Dest)
+			}
+		}
+	}
+}
+
+func (p *process) send(msg Message) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err = p.stdin.Write(append(line, '\n'))
+
+	return err
+}
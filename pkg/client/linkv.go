@@ -0,0 +1,90 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// linKV is a minimal stand-in for Maelstrom's lin-kv service: a single map
+// behind a mutex is trivially linearizable
+type linKV struct {
+	mu     sync.Mutex
+	values map[string]json.RawMessage
+}
+
+type kvRequest struct {
+	Type              string          `json:"type"`
+	MsgID             int             `json:"msg_id"`
+	Key               any             `json:"key"`
+	Value             json.RawMessage `json:"value"`
+	From              json.RawMessage `json:"from"`
+	To                json.RawMessage `json:"to"`
+	CreateIfNotExists bool            `json:"create_if_not_exists"`
+}
+
+func newLinKV() *linKV {
+	return &linKV{values: make(map[string]json.RawMessage)}
+}
+
+func (kv *linKV) handle(msg Message) Message {
+	var req kvRequest
+	var reply map[string]any
+
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		reply = errorBody(maelstrom.MalformedRequest, err.Error())
+	} else {
+		reply = kv.apply(req)
+	}
+	reply["in_reply_to"] = req.MsgID
+
+	body, _ := json.Marshal(reply)
+
+	return Message{Src: msg.Dest, Dest: msg.Src, Body: body}
+}
+
+func (kv *linKV) apply(req kvRequest) map[string]any {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	key, _ := json.Marshal(req.Key)
+	current, exists := kv.values[string(key)]
+
+	switch req.Type {
+	case "read":
+		if !exists {
+			return errorBody(maelstrom.KeyDoesNotExist, "key does not exist")
+		}
+		return map[string]any{"type": "read_ok", "value": current}
+	case "write":
+		kv.values[string(key)] = req.Value
+		return map[string]any{"type": "write_ok"}
+	case "cas":
+		if !exists {
+			if !req.CreateIfNotExists {
+				return errorBody(maelstrom.KeyDoesNotExist, "key does not exist")
+			}
+		} else if !jsonEqual(current, req.From) {
+			return errorBody(maelstrom.PreconditionFailed, "expected "+string(req.From)+", found "+string(current))
+		}
+		kv.values[string(key)] = req.To
+		return map[string]any{"type": "cas_ok"}
+	default:
+		return errorBody(maelstrom.NotSupported, "unsupported kv operation: "+req.Type)
+	}
+}
+
+func errorBody(code int, text string) map[string]any {
+	return map[string]any{"type": "error", "code": code, "text": text}
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return false
+	}
+
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
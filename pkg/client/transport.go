@@ -0,0 +1,82 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"sync"
+)
+
+// Message is a Maelstrom envelope as it travels over the wire
+type Message struct {
+	Src  string          `json:"src"`
+	Dest string          `json:"dest"`
+	Body json.RawMessage `json:"body"`
+}
+
+// Transport moves client messages to a cluster and hands back whatever the
+// cluster sends to its clients
+type Transport interface {
+	Send(msg Message) error
+	// Recv blocks until a message for a client arrives. Lines that do not
+	// decode are dropped, an error means the transport is gone.
+	Recv() (Message, error)
+	Close() error
+}
+
+var ErrClosed = errors.New("transport closed")
+
+// StreamTransport speaks newline delimited JSON over a reader/writer pair, for
+// example the stdin/stdout of a single node process or a socket
+type StreamTransport struct {
+	r *bufio.Scanner
+
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+func NewStreamTransport(r io.Reader, w io.WriteCloser) *StreamTransport {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	return &StreamTransport{r: scanner, w: w, c: w}
+}
+
+func (t *StreamTransport) Send(msg Message) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, err = t.w.Write(append(line, '\n'))
+
+	return err
+}
+
+func (t *StreamTransport) Recv() (Message, error) {
+	for t.r.Scan() {
+		var msg Message
+		if err := json.Unmarshal(t.r.Bytes(), &msg); err != nil {
+			log.Printf("Dropping undecodable message: %v", err)
+			continue
+		}
+
+		return msg, nil
+	}
+
+	if err := t.r.Err(); err != nil {
+		return Message{}, err
+	}
+
+	return Message{}, ErrClosed
+}
+
+func (t *StreamTransport) Close() error {
+	return t.c.Close()
+}
@@ -0,0 +1,263 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/retry"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every tunable of the servers. Each module only reads the
+// sections it needs, so one file can be shared by all of them.
+type Config struct {
+	Broadcast  Broadcast  `json:"broadcast" yaml:"broadcast"`
+	IDs        IDs        `json:"ids" yaml:"ids"`
+	Echo       Echo       `json:"echo" yaml:"echo"`
+	RPC        RPC        `json:"rpc" yaml:"rpc"`
+	Retry      Retry      `json:"retry" yaml:"retry"`
+	Membership Membership `json:"membership" yaml:"membership"`
+
+	// Persistence and diagnostics, all disabled when empty
+	DataDir    string `json:"data_dir" yaml:"data_dir" env:"DATA_DIR"`
+	HistoryDir string `json:"history_dir" yaml:"history_dir" env:"HISTORY_DIR"`
+	RecordDir  string `json:"record_dir" yaml:"record_dir" env:"RECORD_DIR"`
+	TraceDir   string `json:"trace_dir" yaml:"trace_dir" env:"TRACE_DIR"`
+}
+
+type Broadcast struct {
+	Mode         string `json:"mode" yaml:"mode" env:"BROADCAST_MODE"`
+	MessageStore string `json:"message_store" yaml:"message_store" env:"MESSAGE_STORE"`
+	// Center of the hardcoded 25 node topology, and the preferred sequencer
+	MasterNode          string   `json:"master_node" yaml:"master_node" env:"MASTER_NODE"`
+	BatchInterval       Duration `json:"batch_interval" yaml:"batch_interval" env:"BATCH_INTERVAL"`
+	AntiEntropyInterval Duration `json:"anti_entropy_interval" yaml:"anti_entropy_interval" env:"ANTI_ENTROPY_INTERVAL"`
+	SnapshotInterval    Duration `json:"snapshot_interval" yaml:"snapshot_interval" env:"SNAPSHOT_INTERVAL"`
+	SequencerInterval   Duration `json:"sequencer_interval" yaml:"sequencer_interval" env:"SEQUENCER_INTERVAL"`
+	// How broadcast-3c and 3d repair their value sets, every anti-entropy interval
+	Reconciliation string `json:"reconciliation" yaml:"reconciliation" env:"RECONCILIATION"`
+}
+
+type IDs struct {
+	Format string `json:"format" yaml:"format" env:"ID_FORMAT"`
+}
+
+type Echo struct {
+	PingInterval Duration `json:"ping_interval" yaml:"ping_interval" env:"PING_INTERVAL"`
+	PingTimeout  Duration `json:"ping_timeout" yaml:"ping_timeout" env:"PING_TIMEOUT"`
+}
+
+type RPC struct {
+	// How long a single request to a peer or lin-kv may take
+	Timeout Duration `json:"timeout" yaml:"timeout" env:"RPC_TIMEOUT"`
+}
+
+type Retry struct {
+	BaseDelay Duration `json:"base_delay" yaml:"base_delay" env:"RETRY_BASE_DELAY"`
+	// Cap of the exponential backoff, the actual sleep is drawn uniformly below it
+	MaxDelay Duration `json:"max_delay" yaml:"max_delay" env:"RETRY_MAX_DELAY"`
+	// Zero means no limit
+	MaxAttempts      int      `json:"max_attempts" yaml:"max_attempts" env:"RETRY_MAX_ATTEMPTS"`
+	Deadline         Duration `json:"deadline" yaml:"deadline" env:"RETRY_DEADLINE"`
+	BreakerThreshold int      `json:"breaker_threshold" yaml:"breaker_threshold" env:"RETRY_BREAKER_THRESHOLD"`
+	BreakerCooldown  Duration `json:"breaker_cooldown" yaml:"breaker_cooldown" env:"RETRY_BREAKER_COOLDOWN"`
+}
+
+type Membership struct {
+	ProbeInterval    Duration `json:"probe_interval" yaml:"probe_interval" env:"PROBE_INTERVAL"`
+	SuspicionTimeout Duration `json:"suspicion_timeout" yaml:"suspicion_timeout" env:"SUSPICION_TIMEOUT"`
+}
+
+var (
+	BroadcastModes  = []string{"eventual", "causal", "total"}
+	MessageStores   = []string{"map", "bitmap"}
+	Reconciliations = []string{"none", "merkle", "iblt"}
+	IDFormats       = []string{"string", "snowflake", "ulid", "uuidv7", "lease"}
+)
+
+// Default returns the values the servers used before they were configurable
+func Default() Config {
+	return Config{
+		Broadcast: Broadcast{
+			Mode:                "eventual",
+			MessageStore:        "map",
+			MasterNode:          "n12",
+			BatchInterval:       Milliseconds(200),
+			AntiEntropyInterval: Milliseconds(1000),
+			SnapshotInterval:    Milliseconds(10000),
+			SequencerInterval:   Milliseconds(200),
+			Reconciliation:      "none",
+		},
+		IDs: IDs{
+			Format: "string",
+		},
+		Echo: Echo{
+			PingInterval: Milliseconds(1000),
+			PingTimeout:  Milliseconds(5000),
+		},
+		RPC: RPC{
+			Timeout: Milliseconds(1000),
+		},
+		Retry: Retry{
+			BaseDelay:        Milliseconds(10),
+			MaxDelay:         Milliseconds(500),
+			BreakerThreshold: 5,
+			BreakerCooldown:  Milliseconds(1000),
+		},
+		Membership: Membership{
+			ProbeInterval:    Milliseconds(1000),
+			SuspicionTimeout: Milliseconds(5000),
+		},
+	}
+}
+
+// Load starts from the defaults, applies the file named by CONFIG_FILE (YAML
+// for .yaml/.yml, JSON otherwise) and then the environment variables, so a
+// variable always wins over the file. The result is validated.
+func Load() (Config, error) {
+	cfg := Default()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem()); err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+
+	// Unknown keys are rejected, a typo should not silently fall back to a default
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		d := yaml.NewDecoder(bytes.NewReader(data))
+		d.KnownFields(true)
+		err = d.Decode(c)
+	default:
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.DisallowUnknownFields()
+		err = d.Decode(c)
+	}
+
+	if err != nil {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (c Config) Validate() error {
+	var errs []error
+
+	oneOf := func(name, value string, allowed []string) {
+		if !slices.Contains(allowed, value) {
+			errs = append(errs, fmt.Errorf("%s must be one of %v, got %q", name, allowed, value))
+		}
+	}
+	positive := func(name string, d Duration) {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %s", name, d))
+		}
+	}
+
+	oneOf("broadcast.mode", c.Broadcast.Mode, BroadcastModes)
+	oneOf("broadcast.message_store", c.Broadcast.MessageStore, MessageStores)
+	oneOf("broadcast.reconciliation", c.Broadcast.Reconciliation, Reconciliations)
+	oneOf("ids.format", c.IDs.Format, IDFormats)
+
+	if c.Broadcast.MasterNode == "" {
+		errs = append(errs, errors.New("broadcast.master_node must be set"))
+	}
+
+	positive("broadcast.batch_interval", c.Broadcast.BatchInterval)
+	positive("broadcast.anti_entropy_interval", c.Broadcast.AntiEntropyInterval)
+	positive("broadcast.snapshot_interval", c.Broadcast.SnapshotInterval)
+	positive("broadcast.sequencer_interval", c.Broadcast.SequencerInterval)
+	positive("echo.ping_interval", c.Echo.PingInterval)
+	positive("echo.ping_timeout", c.Echo.PingTimeout)
+	positive("rpc.timeout", c.RPC.Timeout)
+	positive("retry.base_delay", c.Retry.BaseDelay)
+	positive("retry.max_delay", c.Retry.MaxDelay)
+	positive("membership.probe_interval", c.Membership.ProbeInterval)
+	positive("membership.suspicion_timeout", c.Membership.SuspicionTimeout)
+
+	if c.Retry.MaxDelay < c.Retry.BaseDelay {
+		errs = append(errs, fmt.Errorf("retry.max_delay (%s) must not be below retry.base_delay (%s)", c.Retry.MaxDelay, c.Retry.BaseDelay))
+	}
+	if c.Retry.MaxAttempts < 0 || c.Retry.Deadline < 0 || c.Retry.BreakerThreshold < 0 || c.Retry.BreakerCooldown < 0 {
+		errs = append(errs, errors.New("retry limits must not be negative"))
+	}
+	if c.Retry.BreakerThreshold > 0 && c.Retry.BreakerCooldown == 0 {
+		errs = append(errs, errors.New("retry.breaker_cooldown must be set when the breaker is enabled"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (r Retry) Policy() retry.Policy {
+	return retry.Policy{
+		BaseDelay:        r.BaseDelay.Duration(),
+		MaxDelay:         r.MaxDelay.Duration(),
+		MaxAttempts:      r.MaxAttempts,
+		Deadline:         r.Deadline.Duration(),
+		BreakerThreshold: r.BreakerThreshold,
+		BreakerCooldown:  r.BreakerCooldown.Duration(),
+	}
+}
+
+// applyEnv overrides every field tagged with env whose variable is set
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		field, value := t.Field(i), v.Field(i)
+
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(Duration(0)) {
+			if err := applyEnv(value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := field.Tag.Get("env")
+		raw, ok := os.LookupEnv(name)
+		if name == "" || !ok {
+			continue
+		}
+
+		switch ptr := value.Addr().Interface().(type) {
+		case *string:
+			*ptr = raw
+		case *int:
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*ptr = n
+		case *Duration:
+			if err := ptr.UnmarshalText([]byte(raw)); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		default:
+			return fmt.Errorf("%s: unsupported field type %s", name, field.Type)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,7 @@
+module github.com/deamondev/gossip-glomers-tutorial/pkg
+
+go 1.25.4
+
+require github.com/jepsen-io/maelstrom/demo/go v0.0.0-20250920002117-21168aa9cdd2
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,61 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EDN renders the op the way Jepsen stores histories, e.g.
+// {:index 0, :type :invoke, :process 1, :f :broadcast, :value 12, :time 1700000000, :node "n1"}
+func (op Op) EDN() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "{:index %d, :type :%s, :process %d, :f :%s, :value %s, :time %d, :node %s",
+		op.Index, op.Type, op.Process, op.F, ednValue(op.Value), op.Time, strconv.Quote(op.Node))
+	if op.Error != "" {
+		fmt.Fprintf(&b, ", :error %s", strconv.Quote(op.Error))
+	}
+	b.WriteString("}")
+
+	return b.String()
+}
+
+func ednValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v)
+	case string:
+		return strconv.Quote(v)
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = ednValue(item)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		items := make([]string, len(keys))
+		for i, k := range keys {
+			items[i] = ":" + k + " " + ednValue(v[k])
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	default:
+		return strconv.Quote(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,349 @@
+package history
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	Invoke = "invoke"
+	OK     = "ok"
+	Fail   = "fail"
+	Info   = "info"
+)
+
+// Op is a single history event, shaped like a Jepsen operation
+type Op struct {
+	Index   int    `json:"index"`
+	Type    string `json:"type"`
+	Process int    `json:"process"`
+	F       string `json:"f"`
+	Value   any    `json:"value"`
+	// Nanoseconds since the Unix epoch, so histories of several nodes can be merged
+	Time  int64  `json:"time"`
+	Node  string `json:"node"`
+	Error string `json:"error,omitempty"`
+}
+
+type requestKey struct {
+	client string
+	msgID  int
+}
+
+type pendingOp struct {
+	process int
+	f       string
+	value   any
+}
+
+type envelope struct {
+	Src  string          `json:"src"`
+	Dest string          `json:"dest"`
+	Body json.RawMessage `json:"body"`
+}
+
+type body struct {
+	Type      string          `json:"type"`
+	MsgID     int             `json:"msg_id"`
+	InReplyTo int             `json:"in_reply_to"`
+	NodeID    string          `json:"node_id"`
+	Code      int             `json:"code"`
+	Text      string          `json:"text"`
+	Message   json.RawMessage `json:"message"`
+	Messages  json.RawMessage `json:"messages"`
+	ID        json.RawMessage `json:"id"`
+}
+
+// Recorder sits between a node and its stdin/stdout and writes every client
+// request as an invoke and every reply as ok, fail or info, both as JSON Lines
+// and as EDN. Node to node traffic, the init/topology setup and debug_state
+// queries are not part of the history.
+type Recorder struct {
+	dir string
+
+	mu      sync.Mutex
+	nodeID  string
+	index   int
+	pending map[requestKey]pendingOp
+	// Written straight through, so the history is complete up to the moment the node dies
+	jsonl *os.File
+	edn   *os.File
+}
+
+// Attach wraps the node's stdin and stdout. The history files are created in
+// dir once the init message tells us the node ID. Maelstrom stops nodes with a
+// signal, so on SIGTERM or SIGINT the recorder closes itself before the node
+// dies.
+func Attach(n *maelstrom.Node, dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create history directory: %w", err)
+	}
+
+	r := &Recorder{
+		dir:     dir,
+		pending: make(map[requestKey]pendingOp),
+	}
+
+	n.Stdin = io.TeeReader(n.Stdin, &lineWriter{fn: r.inbound})
+	n.Stdout = io.MultiWriter(n.Stdout, &lineWriter{fn: r.outbound})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go r.closeOn(signals)
+
+	return r, nil
+}
+
+func (r *Recorder) closeOn(signals chan os.Signal) {
+	sig := <-signals
+	if err := r.Close(); err != nil {
+		log.Printf("Failed to close history: %v", err)
+	}
+
+	// Die the way the signal would have killed us
+	signal.Stop(signals)
+	syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+}
+
+// Close completes requests still waiting for a reply as info, since we cannot
+// know whether they took effect, and closes the history files. Nothing is
+// recorded after it.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, p := range r.pending {
+		r.writeLocked(Op{Type: Info, Process: p.process, F: p.f, Value: p.value, Error: "no reply before shutdown"})
+		delete(r.pending, key)
+	}
+
+	if r.jsonl == nil {
+		return nil
+	}
+
+	err := errors.Join(r.jsonl.Close(), r.edn.Close())
+	r.jsonl, r.edn = nil, nil
+
+	return err
+}
+
+func (r *Recorder) inbound(line []byte) {
+	var msg envelope
+	var b body
+	if json.Unmarshal(line, &msg) != nil || json.Unmarshal(msg.Body, &b) != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if b.Type == "init" {
+		if r.nodeID == "" {
+			r.openLocked(b.NodeID)
+		}
+		return
+	}
+
+	if !isClient(msg.Src) || b.InReplyTo != 0 || b.Type == "topology" || b.Type == "debug_state" {
+		return
+	}
+
+	p := pendingOp{process: process(msg.Src), f: b.Type, value: invokeValue(b, msg.Body)}
+	r.pending[requestKey{client: msg.Src, msgID: b.MsgID}] = p
+
+	r.writeLocked(Op{Type: Invoke, Process: p.process, F: p.f, Value: p.value})
+}
+
+func (r *Recorder) outbound(line []byte) {
+	var msg envelope
+	var b body
+	if json.Unmarshal(line, &msg) != nil || json.Unmarshal(msg.Body, &b) != nil {
+		return
+	}
+
+	if !isClient(msg.Dest) || b.InReplyTo == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := requestKey{client: msg.Dest, msgID: b.InReplyTo}
+	p, ok := r.pending[key]
+	if !ok {
+		return
+	}
+	delete(r.pending, key)
+
+	// Like in Jepsen, a completion repeats the invoked value unless the reply carries one
+	op := Op{Process: p.process, F: p.f, Value: p.value}
+	if b.Type == "error" {
+		op.Type = Fail
+		// Only a definite error proves the operation did not happen
+		if b.Code == maelstrom.Timeout || b.Code == maelstrom.Crash {
+			op.Type = Info
+		}
+		op.Error = maelstrom.ErrorCodeText(b.Code) + ": " + b.Text
+	} else {
+		op.Type = OK
+		if v := completionValue(p.f, b, msg.Body); v != nil {
+			op.Value = v
+		}
+	}
+
+	r.writeLocked(op)
+}
+
+func (r *Recorder) openLocked(nodeID string) {
+	r.nodeID = nodeID
+
+	jsonl, err := os.Create(filepath.Join(r.dir, nodeID+".jsonl"))
+	if err != nil {
+		log.Printf("Failed to create history: %v", err)
+		return
+	}
+
+	edn, err := os.Create(filepath.Join(r.dir, nodeID+".edn"))
+	if err != nil {
+		jsonl.Close()
+		log.Printf("Failed to create history: %v", err)
+		return
+	}
+
+	r.jsonl = jsonl
+	r.edn = edn
+}
+
+func (r *Recorder) writeLocked(op Op) {
+	if r.jsonl == nil {
+		return
+	}
+
+	op.Index = r.index
+	op.Time = time.Now().UnixNano()
+	op.Node = r.nodeID
+	r.index++
+
+	line, err := json.Marshal(op)
+	if err != nil {
+		log.Printf("Failed to encode history op: %v", err)
+		return
+	}
+
+	if _, err := r.jsonl.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write history: %v", err)
+	}
+	if _, err := r.edn.WriteString(op.EDN() + "\n"); err != nil {
+		log.Printf("Failed to write history: %v", err)
+	}
+}
+
+// invokeValue is what the client asked for: the broadcast value, nothing for
+// reads and generates, the whole body for anything else
+func invokeValue(b body, raw json.RawMessage) any {
+	switch b.Type {
+	case "broadcast":
+		return decode(b.Message)
+	case "read", "generate":
+		return nil
+	default:
+		return stripped(raw)
+	}
+}
+
+func completionValue(f string, b body, raw json.RawMessage) any {
+	switch f {
+	case "broadcast":
+		return nil
+	case "read":
+		return decode(b.Messages)
+	case "generate":
+		return decode(b.ID)
+	default:
+		return stripped(raw)
+	}
+}
+
+// stripped returns the body without the protocol fields
+func stripped(raw json.RawMessage) any {
+	var fields map[string]any
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if d.Decode(&fields) != nil {
+		return nil
+	}
+
+	for _, k := range []string{"type", "msg_id", "in_reply_to"} {
+		delete(fields, k)
+	}
+
+	return fields
+}
+
+func decode(raw json.RawMessage) any {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	var v any
+	d := json.NewDecoder(bytes.NewReader(raw))
+	// Keep 64-bit IDs exact
+	d.UseNumber()
+	if d.Decode(&v) != nil {
+		return nil
+	}
+
+	return v
+}
+
+// Maelstrom clients are called c1, c2, ... and their number is the process
+func isClient(id string) bool {
+	return strings.HasPrefix(id, "c")
+}
+
+func process(client string) int {
+	p, err := strconv.Atoi(strings.TrimPrefix(client, "c"))
+	if err != nil {
+		return -1
+	}
+
+	return p
+}
+
+// lineWriter hands every complete line written to it to fn
+type lineWriter struct {
+	mu  sync.Mutex
+	buf []byte
+	fn  func(line []byte)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.fn(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,604 @@
+package membership
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	// How many peers we ask to probe the target on our behalf
+	indirectProbes = 3
+	// Upper bound on the number of updates attached to a single message
+	maxPiggyback = 8
+	// Every update is gossiped retransmitMult * log(n) times before it is dropped
+	retransmitMult = 3
+)
+
+// Detector is a SWIM-style failure detector. Every probe interval it pings one
+// peer directly, falls back to indirect probes through other peers and, if
+// those fail too, marks the peer as suspected. Suspected peers that do not
+// refute the suspicion within suspicionTimeout are declared dead.
+type Detector struct {
+	node *maelstrom.Node
+
+	probeInterval    time.Duration
+	probeTimeout     time.Duration
+	suspicionTimeout time.Duration
+
+	mu          sync.Mutex
+	nodeID      string
+	incarnation uint64
+	left        bool
+	members     map[string]*member
+	probeOrder  []string
+	probeIndex  int
+	updates     []*pendingUpdate
+	subscribers []chan Event
+	changed     chan struct{}
+
+	ticker *time.Ticker
+	done   chan struct{}
+	once   sync.Once
+}
+
+type pendingUpdate struct {
+	update    Update
+	transmits int
+}
+
+type PingMessage struct {
+	Type    string   `json:"type"`
+	Members []Update `json:"members,omitempty"`
+}
+
+type PingMessageResponse struct {
+	Type        string   `json:"type"`
+	Incarnation uint64   `json:"incarnation"`
+	Members     []Update `json:"members,omitempty"`
+}
+
+type PingReqMessage struct {
+	Type    string   `json:"type"`
+	Target  string   `json:"target"`
+	Members []Update `json:"members,omitempty"`
+}
+
+type PingReqMessageResponse struct {
+	Type    string   `json:"type"`
+	Members []Update `json:"members,omitempty"`
+}
+
+func NewDetector(n *maelstrom.Node, probeInterval, suspicionTimeout time.Duration) *Detector {
+	d := &Detector{
+		node:             n,
+		probeInterval:    probeInterval,
+		probeTimeout:     probeInterval / 2,
+		suspicionTimeout: suspicionTimeout,
+		members:          make(map[string]*member),
+		changed:          make(chan struct{}),
+		ticker:           time.NewTicker(probeInterval),
+		done:             make(chan struct{}),
+	}
+
+	d.node.Handle("swim_ping", d.pingHandler)
+	d.node.Handle("swim_ping_req", d.pingReqHandler)
+
+	return d
+}
+
+// Init seeds the member list, it should be called from the module's init handler
+func (d *Detector) Init(nodeID string, nodeIDs []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.nodeID = nodeID
+	for _, peerID := range nodeIDs {
+		if peerID != nodeID {
+			d.addMemberLocked(peerID, Alive, 0)
+		}
+	}
+
+	log.Printf("Failure detector tracking peers: %v", d.probeOrder)
+}
+
+// Run probes every interval until Close, a stopped ticker never closes its
+// channel so Run also waits on done
+func (d *Detector) Run() {
+	for {
+		select {
+		case <-d.ticker.C:
+			d.probe()
+			d.expireSuspects()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *Detector) Close() {
+	d.once.Do(func() {
+		log.Printf("Closing failure detector")
+
+		d.ticker.Stop()
+		close(d.done)
+	})
+}
+
+// Alive reports whether peerID is considered alive. Suspected peers still count
+// as alive, and so do peers we know nothing about. Peers that left do not.
+func (d *Detector) Alive(peerID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.aliveLocked(peerID)
+}
+
+func (d *Detector) State(peerID string) State {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.stateLocked(peerID)
+}
+
+// AliveMembers returns all peers (excluding ourselves) that are neither dead nor gone
+func (d *Detector) AliveMembers() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var alive []string
+	for peerID, m := range d.members {
+		if m.state != Dead && m.state != Left {
+			alive = append(alive, peerID)
+		}
+	}
+	sort.Strings(alive)
+
+	return alive
+}
+
+// Members returns the current node set including ourselves: everybody who has
+// not left, dead or not
+func (d *Detector) Members() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var members []string
+	if !d.left {
+		members = append(members, d.nodeID)
+	}
+	for peerID, m := range d.members {
+		if m.state != Left {
+			members = append(members, peerID)
+		}
+	}
+	sort.Strings(members)
+
+	return members
+}
+
+// WaitAlive blocks until peerID is considered alive again or ctx is done. It
+// returns false if the peer left the cluster, it is not coming back.
+func (d *Detector) WaitAlive(ctx context.Context, peerID string) (bool, error) {
+	for {
+		d.mu.Lock()
+		alive := d.aliveLocked(peerID)
+		left := d.stateLocked(peerID) == Left
+		changed := d.changed
+		d.mu.Unlock()
+
+		if alive {
+			return true, nil
+		}
+		if left {
+			return false, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// Join adds peerID to the cluster, or brings it back if it left before. The
+// news spreads with the rest of the gossip.
+func (d *Detector) Join(peerID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if peerID == d.nodeID {
+		return
+	}
+
+	m, ok := d.members[peerID]
+	switch {
+	case !ok:
+		d.applyLocked(Update{NodeID: peerID, State: Alive})
+	case m.state == Left:
+		d.applyLocked(Update{NodeID: peerID, State: Alive, Incarnation: m.incarnation + 1})
+	}
+}
+
+// Leave announces that we are leaving for good. It stops probing and pushes
+// the news to every alive peer directly, rather than waiting for it to be
+// piggybacked, so it returns once the peers had a chance to hear it.
+func (d *Detector) Leave() {
+	d.mu.Lock()
+	d.left = true
+	d.incarnation++
+	d.enqueueLocked(Update{NodeID: d.nodeID, State: Left, Incarnation: d.incarnation})
+	d.mu.Unlock()
+
+	d.ticker.Stop()
+
+	var wg sync.WaitGroup
+	for _, peerID := range d.AliveMembers() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := d.ping(peerID, d.probeTimeout); err != nil {
+				log.Printf("Failed to tell node %s we are leaving: %v", peerID, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	log.Printf("Left the cluster, incarnation: %d", d.incarnation)
+}
+
+// Subscribe returns a channel on which every membership change is delivered.
+// Events are dropped for subscribers that do not keep up.
+func (d *Detector) Subscribe() <-chan Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan Event, 64)
+	d.subscribers = append(d.subscribers, ch)
+
+	return ch
+}
+
+// Piggyback returns the updates that should be attached to the next outgoing
+// message. Updates that were gossiped often enough are dropped from the queue.
+func (d *Detector) Piggyback() []Update {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.piggybackLocked()
+}
+
+// Merge applies updates received from another node
+func (d *Detector) Merge(updates []Update) {
+	if len(updates) == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, u := range updates {
+		d.applyLocked(u)
+	}
+}
+
+func (d *Detector) pingHandler(msg maelstrom.Message) error {
+	var body PingMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	d.Merge(body.Members)
+
+	d.mu.Lock()
+	pingMessageResponse := PingMessageResponse{
+		Type:        "swim_ping_ok",
+		Incarnation: d.incarnation,
+		Members:     d.piggybackLocked(),
+	}
+	d.mu.Unlock()
+
+	return d.node.Reply(msg, pingMessageResponse)
+}
+
+func (d *Detector) pingReqHandler(msg maelstrom.Message) error {
+	var body PingReqMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	d.Merge(body.Members)
+
+	if err := d.ping(body.Target, d.probeTimeout); err != nil {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "indirect probe of "+body.Target+" timed out")
+	}
+
+	pingReqMessageResponse := PingReqMessageResponse{
+		Type:    "swim_ping_req_ok",
+		Members: d.Piggyback(),
+	}
+
+	return d.node.Reply(msg, pingReqMessageResponse)
+}
+
+func (d *Detector) probe() {
+	d.mu.Lock()
+	target := d.nextTargetLocked()
+	var targetState State
+	if target != "" {
+		targetState = d.members[target].state
+	}
+	d.mu.Unlock()
+
+	// Members that left are kept around so that stale gossip cannot revive them
+	if target == "" || targetState == Left {
+		return
+	}
+
+	if err := d.ping(target, d.probeTimeout); err == nil {
+		return
+	}
+
+	// Dead peers are only pinged directly so that they can rejoin after a partition heals
+	if targetState == Dead {
+		return
+	}
+
+	if d.indirectPing(target) {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if m := d.members[target]; m.state == Alive {
+		d.applyLocked(Update{NodeID: target, State: Suspect, Incarnation: m.incarnation})
+	}
+}
+
+func (d *Detector) ping(target string, timeout time.Duration) error {
+	d.mu.Lock()
+	members := d.piggybackLocked()
+	// Make sure the target learns what we think of it, so it can refute
+	if m, ok := d.members[target]; ok && m.state != Alive {
+		members = append(members, Update{NodeID: target, State: m.state, Incarnation: m.incarnation})
+	}
+	d.mu.Unlock()
+
+	pingMessage := PingMessage{
+		Type:    "swim_ping",
+		Members: members,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	resp, err := d.node.SyncRPC(ctx, target, pingMessage)
+	cancel()
+
+	if err != nil {
+		return err
+	}
+
+	var body PingMessageResponse
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return err
+	}
+
+	d.Merge(append(body.Members, Update{NodeID: target, State: Alive, Incarnation: body.Incarnation}))
+
+	return nil
+}
+
+func (d *Detector) indirectPing(target string) bool {
+	d.mu.Lock()
+	var helpers []string
+	for peerID, m := range d.members {
+		if peerID != target && m.state == Alive {
+			helpers = append(helpers, peerID)
+		}
+	}
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > indirectProbes {
+		helpers = helpers[:indirectProbes]
+	}
+	members := d.piggybackLocked()
+	d.mu.Unlock()
+
+	if len(helpers) == 0 {
+		return false
+	}
+
+	// Helpers need time to run their own direct probe, so we wait for the rest of the interval
+	ctx, cancel := context.WithTimeout(context.Background(), d.probeInterval-d.probeTimeout)
+	defer cancel()
+
+	acks := make(chan bool, len(helpers))
+	for _, helperID := range helpers {
+		go func() {
+			pingReqMessage := PingReqMessage{
+				Type:    "swim_ping_req",
+				Target:  target,
+				Members: members,
+			}
+
+			resp, err := d.node.SyncRPC(ctx, helperID, pingReqMessage)
+			if err != nil {
+				acks <- false
+				return
+			}
+
+			var body PingReqMessageResponse
+			if err := json.Unmarshal(resp.Body, &body); err == nil {
+				d.Merge(body.Members)
+			}
+			acks <- true
+		}()
+	}
+
+	for range helpers {
+		if <-acks {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *Detector) expireSuspects() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for peerID, m := range d.members {
+		if m.state == Suspect && now.Sub(m.suspectedAt) > d.suspicionTimeout {
+			d.applyLocked(Update{NodeID: peerID, State: Dead, Incarnation: m.incarnation})
+		}
+	}
+}
+
+func (d *Detector) applyLocked(u Update) {
+	if u.NodeID == d.nodeID {
+		// Somebody suspects us, refute it by bumping our incarnation
+		if u.State != Alive && u.Incarnation >= d.incarnation && !d.left {
+			d.incarnation = u.Incarnation + 1
+			d.enqueueLocked(Update{NodeID: d.nodeID, State: Alive, Incarnation: d.incarnation})
+			log.Printf("Refuting %s rumour about ourselves, incarnation: %d", u.State, d.incarnation)
+		}
+		return
+	}
+
+	m, ok := d.members[u.NodeID]
+	if !ok {
+		d.addMemberLocked(u.NodeID, u.State, u.Incarnation)
+		d.enqueueLocked(u)
+
+		// A node we have never heard of has joined
+		if u.State != Left {
+			log.Printf("Peer %s joined: %s", u.NodeID, u.State)
+			d.notifyLocked(Event{NodeID: u.NodeID, From: Left, To: u.State})
+		}
+		return
+	}
+
+	if !m.overrides(u) {
+		return
+	}
+
+	from := m.state
+	m.state = u.State
+	m.incarnation = u.Incarnation
+	if u.State == Suspect {
+		m.suspectedAt = time.Now()
+	}
+
+	d.enqueueLocked(u)
+
+	if from != u.State {
+		log.Printf("Peer %s changed state: %s -> %s", u.NodeID, from, u.State)
+		d.notifyLocked(Event{NodeID: u.NodeID, From: from, To: u.State})
+	}
+}
+
+func (d *Detector) addMemberLocked(peerID string, state State, incarnation uint64) {
+	d.members[peerID] = &member{state: state, incarnation: incarnation, suspectedAt: time.Now()}
+
+	// Insert at a random position so that every node probes in a different order
+	i := rand.Intn(len(d.probeOrder) + 1)
+	d.probeOrder = append(d.probeOrder, "")
+	copy(d.probeOrder[i+1:], d.probeOrder[i:])
+	d.probeOrder[i] = peerID
+}
+
+func (d *Detector) nextTargetLocked() string {
+	if len(d.probeOrder) == 0 {
+		return ""
+	}
+
+	if d.probeIndex >= len(d.probeOrder) {
+		rand.Shuffle(len(d.probeOrder), func(i, j int) {
+			d.probeOrder[i], d.probeOrder[j] = d.probeOrder[j], d.probeOrder[i]
+		})
+		d.probeIndex = 0
+	}
+
+	target := d.probeOrder[d.probeIndex]
+	d.probeIndex++
+
+	return target
+}
+
+func (d *Detector) aliveLocked(peerID string) bool {
+	state := d.stateLocked(peerID)
+
+	return state != Dead && state != Left
+}
+
+func (d *Detector) stateLocked(peerID string) State {
+	if m, ok := d.members[peerID]; ok {
+		return m.state
+	}
+
+	return Alive
+}
+
+func (d *Detector) enqueueLocked(u Update) {
+	// A newer update about the same node supersedes the queued one
+	for i, p := range d.updates {
+		if p.update.NodeID == u.NodeID {
+			d.updates = append(d.updates[:i], d.updates[i+1:]...)
+			break
+		}
+	}
+
+	d.updates = append(d.updates, &pendingUpdate{update: u})
+}
+
+func (d *Detector) piggybackLocked() []Update {
+	if len(d.updates) == 0 {
+		return nil
+	}
+
+	// Least gossiped updates go first
+	sort.SliceStable(d.updates, func(i, j int) bool {
+		return d.updates[i].transmits < d.updates[j].transmits
+	})
+
+	limit := retransmitMult * int(math.Ceil(math.Log2(float64(len(d.members)+2))))
+
+	var updates []Update
+	remaining := d.updates[:0]
+	for i, p := range d.updates {
+		if i < maxPiggyback {
+			updates = append(updates, p.update)
+			p.transmits++
+		}
+
+		if p.transmits < limit {
+			remaining = append(remaining, p)
+		}
+	}
+	d.updates = remaining
+
+	return updates
+}
+
+func (d *Detector) notifyLocked(event Event) {
+	close(d.changed)
+	d.changed = make(chan struct{})
+
+	for _, ch := range d.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Dropping membership event for slow subscriber: %+v", event)
+		}
+	}
+}
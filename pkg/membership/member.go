@@ -0,0 +1,79 @@
+package membership
+
+import "time"
+
+type State int
+
+const (
+	Alive State = iota
+	Suspect
+	Dead
+	// Decommissioned on purpose, never probed again unless it rejoins
+	Left
+)
+
+func (st State) String() string {
+	switch st {
+	case Alive:
+		return "ALIVE"
+	case Suspect:
+		return "SUSPECT"
+	case Dead:
+		return "DEAD"
+	case Left:
+		return "LEFT"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Update is a single piece of membership gossip. It is what gets piggybacked
+// on pings, acks and any other message the modules want to attach it to.
+type Update struct {
+	NodeID      string `json:"node_id"`
+	State       State  `json:"state"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+// Event is delivered to subscribers whenever a peer changes its state. A peer
+// that joins goes from Left to Alive.
+type Event struct {
+	NodeID string
+	From   State
+	To     State
+}
+
+type member struct {
+	state       State
+	incarnation uint64
+	suspectedAt time.Time
+}
+
+// overrides tells whether update u should replace what we know about m,
+// following the SWIM precedence rules. Unlike the paper we let a newer alive
+// incarnation revive a dead member, since in maelstrom nodes only ever look
+// dead because of partitions. Leaving wins over everything of the same
+// incarnation, only a rejoin with a newer one brings a member back.
+func (m *member) overrides(u Update) bool {
+	switch u.State {
+	case Alive:
+		return u.Incarnation > m.incarnation
+	case Suspect:
+		if m.state == Alive {
+			return u.Incarnation >= m.incarnation
+		}
+		return u.Incarnation > m.incarnation
+	case Dead:
+		if m.state == Dead || m.state == Left {
+			return u.Incarnation > m.incarnation
+		}
+		return u.Incarnation >= m.incarnation
+	case Left:
+		if m.state == Left {
+			return u.Incarnation > m.incarnation
+		}
+		return u.Incarnation >= m.incarnation
+	}
+
+	return false
+}
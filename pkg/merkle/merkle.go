@@ -0,0 +1,155 @@
+package merkle
+
+import (
+	"math"
+	"slices"
+)
+
+const (
+	// Children per node, a round of the protocol descends one level
+	Fanout = 16
+	// Levels below the root, 16^4 = 65536 leaves
+	Depth = 4
+	// Consecutive values per leaf, the leaves cover 0 ... 2^20-1 evenly, which
+	// is a million values as the broadcast workloads produce them. Anything
+	// below falls into the first leaf and anything above into the last one.
+	LeafWidth = 16
+
+	bitsPerLevel = 4
+	leafCount    = 1 << (bitsPerLevel * Depth)
+)
+
+// Digest summarizes the values below a node. The hash is the XOR of the
+// values' hashes, so it is updated in place on every Add and does not depend
+// on the order values arrived in. The count catches most XOR collisions.
+type Digest struct {
+	Count int `json:"count"`
+	// Encoded as a string, JSON numbers lose precision above 2^53
+	Hash uint64 `json:"hash,string"`
+}
+
+// Tree buckets values by range, leaf i covers i*LeafWidth ... i*LeafWidth +
+// LeafWidth-1. Level d has Fanout^d nodes, node i at level d has children
+// i*Fanout ... i*Fanout+Fanout-1. Only digests are kept, the values of a
+// differing leaf are read back from the set with Range.
+//
+// A Tree is not safe for concurrent use.
+type Tree struct {
+	levels [][]Digest
+}
+
+func New() *Tree {
+	t := &Tree{levels: make([][]Digest, Depth+1)}
+	for d := range t.levels {
+		t.levels[d] = make([]Digest, 1<<(bitsPerLevel*d))
+	}
+
+	return t
+}
+
+// Add inserts a value the caller has not added before, the servers check
+// their set first
+func (t *Tree) Add(v int) {
+	h := hash(v)
+	leaf := leafOf(v)
+
+	for d := range t.levels {
+		i := leaf >> (bitsPerLevel * (Depth - d))
+		t.levels[d][i].Count++
+		t.levels[d][i].Hash ^= h
+	}
+}
+
+func leafOf(v int) int {
+	if v < 0 {
+		return 0
+	}
+
+	return min(v/LeafWidth, leafCount-1)
+}
+
+// Range returns the values a leaf covers as [lo, hi). The first leaf starts
+// at math.MinInt and the last one ends at math.MaxInt, which the range then
+// leaves out; callers check that value on its own.
+func Range(leaf int) (lo, hi int) {
+	lo, hi = leaf*LeafWidth, (leaf+1)*LeafWidth
+	if leaf == 0 {
+		lo = math.MinInt
+	}
+	if leaf == leafCount-1 {
+		hi = math.MaxInt
+	}
+
+	return lo, hi
+}
+
+func (t *Tree) Root() Digest {
+	return t.levels[0][0]
+}
+
+// Digests returns the digests of the given nodes of one level. Out of range
+// indexes get an empty digest.
+func (t *Tree) Digests(level int, indexes []int) []Digest {
+	digests := make([]Digest, len(indexes))
+	if level < 0 || level > Depth {
+		return digests
+	}
+
+	for i, index := range indexes {
+		if index >= 0 && index < len(t.levels[level]) {
+			digests[i] = t.levels[level][index]
+		}
+	}
+
+	return digests
+}
+
+// Differ returns the indexes whose digest on this side does not match theirs
+func (t *Tree) Differ(level int, indexes []int, theirs []Digest) []int {
+	ours := t.Digests(level, indexes)
+
+	var differ []int
+	for i, index := range indexes {
+		if i >= len(theirs) || ours[i] != theirs[i] {
+			differ = append(differ, index)
+		}
+	}
+
+	return differ
+}
+
+// Children expands nodes of one level into all their children on the next
+func Children(indexes []int) []int {
+	children := make([]int, 0, len(indexes)*Fanout)
+	for _, index := range indexes {
+		for c := range Fanout {
+			children = append(children, index*Fanout+c)
+		}
+	}
+
+	return children
+}
+
+// Missing returns the values of theirs that are not in ours, it sorts ours
+func Missing(ours, theirs []int) []int {
+	slices.Sort(ours)
+
+	var missing []int
+	for _, v := range theirs {
+		if _, found := slices.BinarySearch(ours, v); !found {
+			missing = append(missing, v)
+		}
+	}
+
+	return missing
+}
+
+// hash is splitmix64's finalizer, so consecutive values do not cancel out in
+// the XOR of a digest
+func hash(v int) uint64 {
+	z := uint64(v) + 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+
+	return z ^ (z >> 31)
+}
@@ -0,0 +1,227 @@
+package merkle
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Merkle anti-entropy: the initiator walks down the tree one level per round
+// trip, only into nodes whose digests differ, and both sides then swap the
+// values of the differing leaves. Traffic grows with the difference, not with
+// the size of the set.
+
+// Node input lines are limited to 64KB, so a level or a set of leaves that
+// differs in many places is compared over several messages
+const (
+	maxIndexesPerMessage = 512
+	maxLeavesPerMessage  = 128
+)
+
+type TreeMessage struct {
+	Type    string   `json:"type"`
+	Level   int      `json:"level"`
+	Indexes []int    `json:"indexes"`
+	Digests []Digest `json:"digests"`
+}
+
+type TreeMessageResponse struct {
+	Type   string `json:"type"`
+	Differ []int  `json:"differ"`
+}
+
+type LeavesMessage struct {
+	Type   string `json:"type"`
+	Leaves []int  `json:"leaves"`
+	Values []int  `json:"values"`
+}
+
+type LeavesMessageResponse struct {
+	Type string `json:"type"`
+	// What the initiator lacks in the leaves it sent
+	Values []int `json:"values"`
+}
+
+// Store is the value set a Reconciler repairs. It is only used with the
+// Reconciler's lock held.
+type Store interface {
+	// ExportRange returns the sorted values in [lo, hi)
+	ExportRange(lo, hi int) []int
+	Contains(v int) bool
+	// Add keeps a value learned from a peer, and adds it to the tree if it
+	// is new. It returns false if the value was known.
+	Add(v int) bool
+}
+
+// Reconciler runs the protocol over a node's tree and value set. mu is the
+// lock the node already guards both with.
+type Reconciler struct {
+	node    *maelstrom.Node
+	timeout time.Duration
+
+	mu    sync.Locker
+	tree  *Tree
+	store Store
+}
+
+func NewReconciler(n *maelstrom.Node, timeout time.Duration, mu sync.Locker, tree *Tree, store Store) *Reconciler {
+	return &Reconciler{node: n, timeout: timeout, mu: mu, tree: tree, store: store}
+}
+
+// Reconcile walks the trees with one peer and swaps the values they differ in
+func (r *Reconciler) Reconcile(peerID string) error {
+	level, differ := 0, []int{0}
+	for {
+		var next []int
+		for indexes := range slices.Chunk(differ, maxIndexesPerMessage) {
+			r.mu.Lock()
+			treeMessage := TreeMessage{
+				Type:    "merkle",
+				Level:   level,
+				Indexes: indexes,
+				Digests: r.tree.Digests(level, indexes),
+			}
+			r.mu.Unlock()
+
+			var treeMessageResponse TreeMessageResponse
+			if err := r.call(peerID, treeMessage, &treeMessageResponse); err != nil {
+				return err
+			}
+			next = append(next, treeMessageResponse.Differ...)
+		}
+
+		if len(next) == 0 {
+			return nil
+		}
+		if level == Depth {
+			differ = next
+			break
+		}
+		level, differ = level+1, Children(next)
+	}
+
+	added := 0
+	for leaves := range slices.Chunk(differ, maxLeavesPerMessage) {
+		r.mu.Lock()
+		leavesMessage := LeavesMessage{
+			Type:   "merkle_leaves",
+			Leaves: leaves,
+			Values: r.values(leaves),
+		}
+		r.mu.Unlock()
+
+		var leavesMessageResponse LeavesMessageResponse
+		if err := r.call(peerID, leavesMessage, &leavesMessageResponse); err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		for _, v := range leavesMessageResponse.Values {
+			if r.store.Add(v) {
+				added++
+			}
+		}
+		r.mu.Unlock()
+	}
+
+	if added > 0 {
+		log.Printf("Reconciliation with %s recovered %d values from %d leaves", peerID, added, len(differ))
+	}
+
+	return nil
+}
+
+func (r *Reconciler) call(peerID string, body any, response any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	resp, err := r.node.SyncRPC(ctx, peerID, body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(resp.Body, response)
+}
+
+// values reads the given leaves back from the store. Runs of adjacent leaves
+// are exported in one go, out of range leaves are skipped.
+func (r *Reconciler) values(leaves []int) []int {
+	var values []int
+	for i := 0; i < len(leaves); {
+		first := leaves[i]
+		for i++; i < len(leaves) && leaves[i] == leaves[i-1]+1; i++ {
+		}
+		last := leaves[i-1]
+
+		first, last = max(first, 0), min(last, leafCount-1)
+		if first > last {
+			continue
+		}
+
+		lo, _ := Range(first)
+		_, hi := Range(last)
+		values = append(values, r.store.ExportRange(lo, hi)...)
+		if hi == math.MaxInt && r.store.Contains(math.MaxInt) {
+			values = append(values, math.MaxInt)
+		}
+	}
+
+	return values
+}
+
+func (r *Reconciler) TreeHandler(msg maelstrom.Message) error {
+	var body TreeMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	treeMessageResponse := TreeMessageResponse{
+		Type:   "merkle_ok",
+		Differ: r.tree.Differ(body.Level, body.Indexes, body.Digests),
+	}
+
+	return r.node.Reply(msg, treeMessageResponse)
+}
+
+// LeavesHandler keeps what the initiator has and we lack, and answers with
+// the opposite
+func (r *Reconciler) LeavesHandler(msg maelstrom.Message) error {
+	var body LeavesMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ours := r.values(body.Leaves)
+	theirs := body.Values
+	lacking := Missing(theirs, ours)
+
+	added := 0
+	for _, v := range Missing(ours, theirs) {
+		if r.store.Add(v) {
+			added++
+		}
+	}
+
+	if added > 0 {
+		log.Printf("Reconciliation from %s recovered %d values", msg.Src, added)
+	}
+
+	leavesMessageResponse := LeavesMessageResponse{
+		Type:   "merkle_leaves_ok",
+		Values: lacking,
+	}
+
+	return r.node.Reply(msg, leavesMessageResponse)
+}
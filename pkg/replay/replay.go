@@ -0,0 +1,164 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Record is one line the node read or wrote, and when. Only read lines are
+// played back, written ones are kept to draw the run with lamport.
+type Record struct {
+	Offset  time.Duration   `json:"offset_ns"`
+	Time    time.Time       `json:"time,omitzero"`
+	Sent    bool            `json:"sent,omitempty"`
+	Message json.RawMessage `json:"message"`
+}
+
+// Recorder tees everything a node reads from stdin and writes to stdout into
+// <dir>/<node id>.replay.jsonl. Every line is written straight through, so the
+// file is complete up to the moment the node dies.
+type Recorder struct {
+	dir string
+
+	mu    sync.Mutex
+	start time.Time
+	file  *os.File
+}
+
+// tap splits one direction of the stream into lines
+type tap struct {
+	r    *Recorder
+	sent bool
+	buf  []byte
+}
+
+// Attach starts recording the node's input and output. The file is named after
+// the node ID from the init message, which is always the first line Maelstrom sends.
+func Attach(n *maelstrom.Node, dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create record directory: %w", err)
+	}
+
+	r := &Recorder{dir: dir}
+	n.Stdin = io.TeeReader(n.Stdin, &tap{r: r})
+	n.Stdout = io.MultiWriter(n.Stdout, &tap{r: r, sent: true})
+
+	return r, nil
+}
+
+func (t *tap) Write(p []byte) (int, error) {
+	t.r.mu.Lock()
+	defer t.r.mu.Unlock()
+
+	now := time.Now()
+
+	t.buf = append(t.buf, p...)
+	for {
+		i := bytes.IndexByte(t.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := t.buf[:i]
+		t.buf = t.buf[i+1:]
+
+		if err := t.r.recordLocked(now, line, t.sent); err != nil {
+			// Never fail the node's read or write because of the recording
+			log.Printf("Failed to record message: %v", err)
+		}
+	}
+
+	return len(p), nil
+}
+
+func (r *Recorder) recordLocked(now time.Time, line []byte, sent bool) error {
+	if !json.Valid(line) {
+		return nil
+	}
+
+	if r.file == nil {
+		var msg struct {
+			Src  string `json:"src"`
+			Body struct {
+				NodeID string `json:"node_id"`
+			} `json:"body"`
+		}
+		json.Unmarshal(line, &msg)
+
+		name := msg.Body.NodeID
+		if sent {
+			name = msg.Src
+		}
+		if name == "" {
+			name = fmt.Sprintf("pid-%d", os.Getpid())
+		}
+
+		f, err := os.Create(filepath.Join(r.dir, name+".replay.jsonl"))
+		if err != nil {
+			return err
+		}
+		r.file = f
+		r.start = now
+	}
+
+	record, err := json.Marshal(Record{Offset: now.Sub(r.start), Time: now, Sent: sent, Message: line})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.file.Write(append(record, '\n'))
+
+	return err
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	return r.file.Close()
+}
+
+// Play writes the recorded messages to w, each one at its original offset
+// divided by speed. A speed of zero sends everything as fast as possible.
+func Play(rec io.Reader, w io.Writer, speed float64) (int, error) {
+	scanner := bufio.NewScanner(rec)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	start := time.Now()
+	count := 0
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return count, fmt.Errorf("record %d: %w", count+1, err)
+		}
+		if record.Sent {
+			continue
+		}
+
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(record.Offset) / speed))
+			time.Sleep(time.Until(due))
+		}
+
+		if _, err := w.Write(append(record.Message, '\n')); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, scanner.Err()
+}
@@ -0,0 +1,73 @@
+package retry
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	closed breakerState = iota
+	open
+	halfOpen
+)
+
+// Breaker stops calls to a peer after threshold consecutive failures. Once the
+// cooldown passes a single probe is let through: if it succeeds the breaker
+// closes again, otherwise it stays open for another cooldown.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// allow returns how long the caller has to wait before it may call the peer,
+// zero means go ahead
+func (b *Breaker) allow() time.Duration {
+	if b.threshold <= 0 {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case open:
+		if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+			return wait
+		}
+		b.state = halfOpen
+		return 0
+	case halfOpen:
+		// Somebody is probing already, check back shortly
+		return b.cooldown / 10
+	default:
+		return 0
+	}
+}
+
+func (b *Breaker) record(success bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		b.state = closed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == halfOpen || b.failures >= b.threshold {
+		b.state = open
+		b.openedAt = time.Now()
+	}
+}
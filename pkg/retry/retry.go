@@ -0,0 +1,179 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Policy describes how a call is retried. Zero MaxAttempts and Deadline mean
+// there is no limit.
+type Policy struct {
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int
+	Deadline    time.Duration
+
+	// Consecutive indefinite failures after which a peer's breaker opens
+	BreakerThreshold int
+	// How long an open breaker rejects calls before letting a single probe through
+	BreakerCooldown time.Duration
+}
+
+// Retryable reports whether err may be retried. Maelstrom's definite errors
+// (the operation certainly did not happen and never will as requested) are
+// final, with the exception of temporarily-unavailable. Timeouts and crashes
+// are indefinite: the request may or may not have taken effect.
+func Retryable(err error) bool {
+	var permanent *permanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	switch maelstrom.ErrorCode(err) {
+	case maelstrom.Timeout, maelstrom.Crash, maelstrom.TemporarilyUnavailable:
+		return true
+	case -1:
+		// Not an RPC error, e.g. a transport failure
+		return !errors.Is(err, context.Canceled)
+	default:
+		return false
+	}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as final, Do returns it without retrying
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Retrier runs calls against peers according to a policy and keeps a circuit
+// breaker for every peer it has talked to
+type Retrier struct {
+	policy Policy
+
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+
+	inFlight atomic.Int64
+}
+
+func New(policy Policy) *Retrier {
+	return &Retrier{
+		policy:   policy,
+		breakers: make(map[string]*Breaker),
+	}
+}
+
+// Do calls fn until it succeeds, fails definitely, or the policy runs out of
+// attempts or time. While the peer's breaker is open Do waits instead of
+// calling fn, those waits do not count as attempts.
+func (r *Retrier) Do(ctx context.Context, peerID string, fn func(ctx context.Context) error) error {
+	if r.policy.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.policy.Deadline)
+		defer cancel()
+	}
+
+	r.inFlight.Add(1)
+	defer r.inFlight.Add(-1)
+
+	breaker := r.breaker(peerID)
+
+	var err error
+	for attempt := 0; r.policy.MaxAttempts == 0 || attempt < r.policy.MaxAttempts; {
+		if wait := breaker.allow(); wait > 0 {
+			if sleepErr := sleep(ctx, wait); sleepErr != nil {
+				return errors.Join(sleepErr, err)
+			}
+			continue
+		}
+
+		err = fn(ctx)
+		if err == nil || !Retryable(err) {
+			// A definite error still proves the peer is responsive
+			breaker.record(true)
+			return err
+		}
+		breaker.record(false)
+
+		attempt++
+		if sleepErr := sleep(ctx, r.backoff(attempt)); sleepErr != nil {
+			return errors.Join(sleepErr, err)
+		}
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %w", r.policy.MaxAttempts, err)
+}
+
+// InFlight returns the number of calls that have not finished retrying yet
+func (r *Retrier) InFlight() int {
+	return int(r.inFlight.Load())
+}
+
+func (r *Retrier) breaker(peerID string) *Breaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.breakers[peerID]
+	if !ok {
+		b = &Breaker{threshold: r.policy.BreakerThreshold, cooldown: r.policy.BreakerCooldown}
+		r.breakers[peerID] = b
+	}
+
+	return b
+}
+
+// backoff is exponential with full jitter: a uniformly random delay between
+// zero and min(MaxDelay, BaseDelay * 2^attempt)
+func (r *Retrier) backoff(attempt int) time.Duration {
+	ceiling := r.policy.MaxDelay
+	if shift := attempt - 1; shift < 32 {
+		if d := r.policy.BaseDelay << shift; d > 0 && (ceiling == 0 || d < ceiling) {
+			ceiling = d
+		}
+	}
+
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,67 @@
+package sketch
+
+import "math"
+
+const (
+	// Bits per value at 1% false positives with bloomHashes hashes
+	bitsPerValue = 10
+	bloomHashes  = 7
+)
+
+// Bloom is a plain Bloom filter, the fallback when an IBLT does not decode.
+// Its size grows with the set, so the servers split a large set over several
+// filters. Bits is sent base64 encoded. Seed changes the hashes, a value that
+// hit a false positive in one round is unlikely to hit one in the next.
+type Bloom struct {
+	Bits []byte `json:"bits"`
+	Seed uint64 `json:"seed,string"`
+}
+
+// NewBloom sizes a filter for n values
+func NewBloom(n int, seed uint64) *Bloom {
+	bytes := max(1, int(math.Ceil(float64(n*bitsPerValue)/8)))
+
+	return &Bloom{Bits: make([]byte, bytes), Seed: seed}
+}
+
+func (b *Bloom) Add(v int) {
+	for _, bit := range b.bits(v) {
+		b.Bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Contains has false positives but no false negatives
+func (b *Bloom) Contains(v int) bool {
+	if len(b.Bits) == 0 {
+		return false
+	}
+
+	for _, bit := range b.bits(v) {
+		if b.Bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bits derives the hashes from two, as in Kirsch and Mitzenmacher
+func (b *Bloom) bits(v int) [bloomHashes]uint64 {
+	size := uint64(len(b.Bits)) * 8
+	h1 := mix(uint64(v) ^ b.Seed)
+	h2 := mix(h1) | 1
+
+	var bits [bloomHashes]uint64
+	for i := range bits {
+		bits[i] = (h1 + uint64(i)*h2) % size
+	}
+
+	return bits
+}
+
+// Partition spreads values over n filters by hash
+func Partition(v, n int) int {
+	return int(mix(uint64(v)^partitionSeed) % uint64(n))
+}
+
+const partitionSeed = 0x510e527fade682d1
@@ -0,0 +1,135 @@
+package sketch
+
+const (
+	// Cells per table, the message stays the same size whatever the set size.
+	// With three hashes a table this size decodes about 80 differences.
+	Cells = 120
+	// Hashes per value, each one picks a cell in its own third of the table
+	hashCount = 3
+)
+
+// Cell of an invertible Bloom lookup table. KeySum is the XOR of the values in
+// the cell and HashSum the XOR of their check hashes, which tells a cell that
+// holds a single value apart from a mix.
+type Cell struct {
+	Count   int    `json:"count"`
+	KeySum  uint64 `json:"key_sum,string"`
+	HashSum uint64 `json:"hash_sum,string"`
+}
+
+// IBLT is kept up to date next to the value set, so a sketch of the set is
+// ready without scanning it. Subtracting a peer's table cancels every value
+// both have, what is left decodes into the symmetric difference as long as it
+// is small enough.
+//
+// An IBLT is not safe for concurrent use.
+type IBLT struct {
+	cells []Cell
+}
+
+func NewIBLT() *IBLT {
+	return &IBLT{cells: make([]Cell, Cells)}
+}
+
+// Insert adds a value the caller has not inserted before
+func (t *IBLT) Insert(v int) {
+	key := uint64(v)
+	check := mix(key ^ checkSeed)
+	for j := range hashCount {
+		c := &t.cells[cellIndex(key, j)]
+		c.Count++
+		c.KeySum ^= key
+		c.HashSum ^= check
+	}
+}
+
+// Cells returns a copy of the table to send to a peer
+func (t *IBLT) Cells() []Cell {
+	cells := make([]Cell, len(t.cells))
+	copy(cells, t.cells)
+
+	return cells
+}
+
+// Count is how many values were inserted into a table, every value adds
+// hashCount to the cell counts
+func Count(cells []Cell) int {
+	total := 0
+	for _, c := range cells {
+		total += c.Count
+	}
+
+	return total / hashCount
+}
+
+// Diff subtracts a peer's table from ours and peels the result. ours holds the
+// values only we have, theirs the values only the peer has. ok is false when the
+// difference is too large to decode, or when peer is not a table of the
+// same size; both lists are then incomplete.
+func (t *IBLT) Diff(peer []Cell) (ours, theirs []int, ok bool) {
+	if len(peer) != len(t.cells) {
+		return nil, nil, false
+	}
+
+	cells := make([]Cell, len(t.cells))
+	for i := range cells {
+		cells[i] = Cell{
+			Count:   t.cells[i].Count - peer[i].Count,
+			KeySum:  t.cells[i].KeySum ^ peer[i].KeySum,
+			HashSum: t.cells[i].HashSum ^ peer[i].HashSum,
+		}
+	}
+
+	// Peel pure cells, removing a value can make its other cells pure
+	for progress := true; progress; {
+		progress = false
+		for i := range cells {
+			c := cells[i]
+			if (c.Count != 1 && c.Count != -1) || mix(c.KeySum^checkSeed) != c.HashSum {
+				continue
+			}
+
+			v := int(c.KeySum)
+			if c.Count == 1 {
+				ours = append(ours, v)
+			} else {
+				theirs = append(theirs, v)
+			}
+
+			check := mix(c.KeySum ^ checkSeed)
+			for j := range hashCount {
+				d := &cells[cellIndex(c.KeySum, j)]
+				d.Count -= c.Count
+				d.KeySum ^= c.KeySum
+				d.HashSum ^= check
+			}
+			progress = true
+		}
+	}
+
+	for _, c := range cells {
+		if c != (Cell{}) {
+			return ours, theirs, false
+		}
+	}
+
+	return ours, theirs, true
+}
+
+const checkSeed = 0x6a09e667f3bcc908
+
+var cellSeeds = [hashCount]uint64{0xbb67ae8584caa73b, 0x3c6ef372fe94f82b, 0xa54ff53a5f1d36f1}
+
+func cellIndex(key uint64, j int) int {
+	part := Cells / hashCount
+	return j*part + int(mix(key^cellSeeds[j])%uint64(part))
+}
+
+// mix is splitmix64's finalizer
+func mix(z uint64) uint64 {
+	z += 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+
+	return z ^ (z >> 31)
+}
@@ -0,0 +1,239 @@
+package sketch
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// IBLT anti-entropy: the initiator sends its fixed-size table, the peer
+// subtracts its own and decodes the symmetric difference. It keeps what it
+// lacked and answers with what the initiator lacks, one round trip. A
+// difference too large to decode falls back to Bloom filters of the
+// initiator's set, which only repair the initiator; the peer catches up when
+// it initiates itself.
+
+// Node input lines are limited to 64KB, a filter covers about this many values
+const bloomValuesPerMessage = 4096
+
+type IBLTMessage struct {
+	Type  string `json:"type"`
+	Cells []Cell `json:"cells"`
+}
+
+type IBLTMessageResponse struct {
+	Type    string `json:"type"`
+	Decoded bool   `json:"decoded"`
+	// When decoded, what the initiator lacks
+	Values []int `json:"values,omitempty"`
+	// When not, sizes the Bloom filters
+	Count int `json:"count"`
+}
+
+type BloomMessage struct {
+	Type string `json:"type"`
+	// The filter only covers values with Partition(v, Partitions) == Partition
+	Partition  int   `json:"partition"`
+	Partitions int   `json:"partitions"`
+	Filter     Bloom `json:"filter"`
+}
+
+type BloomMessageResponse struct {
+	Type string `json:"type"`
+	// What the initiator lacks in the partition
+	Values []int `json:"values"`
+}
+
+// Store is the value set a Reconciler repairs. It is only used with the
+// Reconciler's lock held.
+type Store interface {
+	Count() int
+	Iterate(fn func(v int) bool)
+	// Add keeps a value learned from a peer, and inserts it into the table if
+	// it is new. It returns false if the value was known.
+	Add(v int) bool
+}
+
+// Reconciler runs the protocol over a node's table and value set. mu is the
+// lock the node already guards both with.
+type Reconciler struct {
+	node    *maelstrom.Node
+	timeout time.Duration
+
+	mu    sync.Locker
+	table *IBLT
+	store Store
+}
+
+func NewReconciler(n *maelstrom.Node, timeout time.Duration, mu sync.Locker, table *IBLT, store Store) *Reconciler {
+	return &Reconciler{node: n, timeout: timeout, mu: mu, table: table, store: store}
+}
+
+// Reconcile swaps tables with one peer, and falls back to Bloom filters when
+// the difference does not decode
+func (r *Reconciler) Reconcile(peerID string) error {
+	r.mu.Lock()
+	ibltMessage := IBLTMessage{
+		Type:  "iblt",
+		Cells: r.table.Cells(),
+	}
+	count := r.store.Count()
+	r.mu.Unlock()
+
+	var ibltMessageResponse IBLTMessageResponse
+	if err := r.call(peerID, ibltMessage, &ibltMessageResponse); err != nil {
+		return err
+	}
+
+	if !ibltMessageResponse.Decoded {
+		return r.exchangeBloom(peerID, max(count, ibltMessageResponse.Count))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	added := 0
+	for _, v := range ibltMessageResponse.Values {
+		if r.store.Add(v) {
+			added++
+		}
+	}
+
+	if added > 0 {
+		log.Printf("Sketch exchange with %s recovered %d values", peerID, added)
+	}
+
+	return nil
+}
+
+// exchangeBloom splits our set over enough filters that neither side's share
+// of a partition outgrows a message
+func (r *Reconciler) exchangeBloom(peerID string, size int) error {
+	partitions := max(1, (size+bloomValuesPerMessage-1)/bloomValuesPerMessage)
+	// Fresh hashes every time, so a false positive does not hide a value forever
+	seed := rand.Uint64()
+
+	r.mu.Lock()
+	filters := make([]*Bloom, partitions)
+	for p := range filters {
+		filters[p] = NewBloom(r.store.Count()/partitions+1, seed)
+	}
+	r.store.Iterate(func(v int) bool {
+		filters[Partition(v, partitions)].Add(v)
+		return true
+	})
+	r.mu.Unlock()
+
+	added := 0
+	for p, filter := range filters {
+		bloomMessage := BloomMessage{
+			Type:       "bloom",
+			Partition:  p,
+			Partitions: partitions,
+			Filter:     *filter,
+		}
+
+		var bloomMessageResponse BloomMessageResponse
+		if err := r.call(peerID, bloomMessage, &bloomMessageResponse); err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		for _, v := range bloomMessageResponse.Values {
+			if r.store.Add(v) {
+				added++
+			}
+		}
+		r.mu.Unlock()
+	}
+
+	log.Printf("Sketch with %s did not decode, %d Bloom filters recovered %d values", peerID, partitions, added)
+
+	return nil
+}
+
+func (r *Reconciler) call(peerID string, body any, response any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	resp, err := r.node.SyncRPC(ctx, peerID, body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(resp.Body, response)
+}
+
+func (r *Reconciler) IBLTHandler(msg maelstrom.Message) error {
+	var body IBLTMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ours, theirs, ok := r.table.Diff(body.Cells)
+	if !ok {
+		ibltMessageResponse := IBLTMessageResponse{
+			Type:  "iblt_ok",
+			Count: r.store.Count(),
+		}
+
+		return r.node.Reply(msg, ibltMessageResponse)
+	}
+
+	added := 0
+	for _, v := range theirs {
+		if r.store.Add(v) {
+			added++
+		}
+	}
+
+	if added > 0 {
+		log.Printf("Sketch from %s recovered %d values", msg.Src, added)
+	}
+
+	ibltMessageResponse := IBLTMessageResponse{
+		Type:    "iblt_ok",
+		Decoded: true,
+		Values:  ours,
+		Count:   r.store.Count(),
+	}
+
+	return r.node.Reply(msg, ibltMessageResponse)
+}
+
+func (r *Reconciler) BloomHandler(msg maelstrom.Message) error {
+	var body BloomMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	if body.Partitions <= 0 || body.Partition < 0 || body.Partition >= body.Partitions {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "partition out of range")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var lacking []int
+	r.store.Iterate(func(v int) bool {
+		if Partition(v, body.Partitions) == body.Partition && !body.Filter.Contains(v) {
+			lacking = append(lacking, v)
+		}
+		return true
+	})
+
+	bloomMessageResponse := BloomMessageResponse{
+		Type:   "bloom_ok",
+		Values: lacking,
+	}
+
+	return r.node.Reply(msg, bloomMessageResponse)
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	walFile      = "wal.log"
+	snapshotFile = "snapshot.json"
+
+	// length + crc32 of the payload
+	headerSize = 8
+
+	// A record holds one state change, anything longer is a corrupt header
+	maxRecordSize = 16 << 20
+)
+
+// Store keeps an append-only write-ahead log next to the latest snapshot.
+// Records are replayed on top of the snapshot during recovery, and since a
+// crash may happen between writing a snapshot and truncating the log, applying
+// a record must be idempotent.
+type Store struct {
+	dir string
+
+	mu  sync.Mutex
+	wal *os.File
+}
+
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data directory: %w", err)
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open wal: %w", err)
+	}
+
+	return &Store{dir: dir, wal: wal}, nil
+}
+
+// Recover returns the latest snapshot (nil if there is none) and every record
+// appended after it. A torn record at the end of the log, left by a crash in
+// the middle of a write, is cut off.
+func (st *Store) Recover() ([]byte, [][]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	snapshot, err := os.ReadFile(filepath.Join(st.dir, snapshotFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("read snapshot: %w", err)
+	}
+
+	if _, err := st.wal.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	info, err := st.wal.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("stat wal: %w", err)
+	}
+
+	var records [][]byte
+	var offset int64
+
+	r := bufio.NewReader(st.wal)
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+
+		length := binary.BigEndian.Uint32(header[:4])
+		checksum := binary.BigEndian.Uint32(header[4:])
+
+		// A header torn mid-write can claim any length, so it is only trusted
+		// as far as the file goes
+		if length > maxRecordSize || int64(length) > info.Size()-offset-headerSize {
+			break
+		}
+
+		record := make([]byte, length)
+		if _, err := io.ReadFull(r, record); err != nil {
+			break
+		}
+
+		if crc32.ChecksumIEEE(record) != checksum {
+			break
+		}
+
+		records = append(records, record)
+		offset += headerSize + int64(length)
+	}
+
+	if err := st.wal.Truncate(offset); err != nil {
+		return nil, nil, fmt.Errorf("truncate torn wal tail: %w", err)
+	}
+
+	if _, err := st.wal.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("Recovered snapshot of %d bytes and %d wal records from %s", len(snapshot), len(records), st.dir)
+
+	return snapshot, records, nil
+}
+
+// Append writes the records and syncs them to disk before returning
+func (st *Store) Append(records ...[]byte) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var buf []byte
+	for _, record := range records {
+		if len(record) > maxRecordSize {
+			return fmt.Errorf("record of %d bytes exceeds %d", len(record), maxRecordSize)
+		}
+
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(record)))
+		buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(record))
+		buf = append(buf, record...)
+	}
+
+	if _, err := st.wal.Write(buf); err != nil {
+		return fmt.Errorf("append to wal: %w", err)
+	}
+
+	return st.wal.Sync()
+}
+
+// Snapshot atomically replaces the snapshot with state and empties the log
+func (st *Store) Snapshot(state []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	tmp := filepath.Join(st.dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+
+	if _, err := f.Write(state); err != nil {
+		f.Close()
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync snapshot: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(st.dir, snapshotFile)); err != nil {
+		return fmt.Errorf("install snapshot: %w", err)
+	}
+
+	// The rename itself is only durable once the directory is synced
+	if dir, err := os.Open(st.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	if err := st.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+
+	_, err = st.wal.Seek(0, io.SeekStart)
+
+	return err
+}
+
+func (st *Store) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.wal.Close()
+}
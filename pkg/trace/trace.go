@@ -0,0 +1,55 @@
+package trace
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"time"
+)
+
+// Context travels inside message bodies next to the value it traces. The span
+// ID is the span the next hop should hang its own span from.
+type Context struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id"`
+	Hop     int    `json:"hop"`
+	// Stamped by the sender's batcher, unix nanoseconds
+	QueuedAt  int64 `json:"queued_at,omitempty"`
+	FlushedAt int64 `json:"flushed_at,omitempty"`
+}
+
+func (c Context) Valid() bool {
+	return c.TraceID != ""
+}
+
+// Child is the context of the next hop, hung from this one's span
+func (c Context) Child() Context {
+	return Context{TraceID: c.TraceID, SpanID: NewSpanID(), Hop: c.Hop + 1}
+}
+
+// Span follows the OpenTelemetry data model, it is converted to OTLP when exported
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]any
+}
+
+func NewTraceID() string {
+	return randomHex(16)
+}
+
+func NewSpanID() string {
+	return randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(rand.Intn(256))
+	}
+
+	return hex.EncodeToString(b)
+}
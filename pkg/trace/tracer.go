@@ -0,0 +1,208 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Tracer appends every finished span to <dir>/<node id>.traces.jsonl as it is
+// recorded, so the file is complete up to the moment the node dies. Every line
+// is an OTLP/JSON ExportTraceServiceRequest, the same format the OpenTelemetry
+// Collector's file exporter writes, so the files can be loaded into Jaeger or
+// any other OTLP tool. A nil Tracer records nothing.
+type Tracer struct {
+	dir     string
+	service string
+
+	mu     sync.Mutex
+	nodeID string
+	file   *os.File
+}
+
+func NewTracer(dir, service string) *Tracer {
+	return &Tracer{dir: dir, service: service}
+}
+
+// Init opens the node's file, it should be called from the module's init handler
+func (t *Tracer) Init(nodeID string) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := os.MkdirAll(t.dir, 0o755); err != nil {
+		return fmt.Errorf("create trace directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(t.dir, nodeID+".traces.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open trace file: %w", err)
+	}
+
+	t.nodeID = nodeID
+	t.file = f
+
+	return nil
+}
+
+func (t *Tracer) Enabled() bool {
+	return t != nil
+}
+
+// Record writes the span right away, spans finished before Init are dropped
+func (t *Tracer) Record(span Span) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.file == nil {
+		return
+	}
+
+	line, err := json.Marshal(t.exportLocked(span))
+	if err != nil {
+		log.Printf("Failed to encode span: %v", err)
+		return
+	}
+
+	if _, err := t.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write span: %v", err)
+	}
+}
+
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+
+	log.Printf("Closing tracer")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// OTLP/JSON, see opentelemetry-proto's trace.proto: IDs are hex strings,
+// 64-bit integers are decimal strings and field names are camelCase
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+// SPAN_KIND_INTERNAL
+const spanKindInternal = 1
+
+func (t *Tracer) exportLocked(span Span) exportRequest {
+	spans := []otlpSpan{{
+		TraceID:           span.TraceID,
+		SpanID:            span.SpanID,
+		ParentSpanID:      span.ParentSpanID,
+		Name:              span.Name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Attributes:        attributes(span.Attributes),
+	}}
+
+	return exportRequest{
+		ResourceSpans: []resourceSpans{{
+			Resource: resource{Attributes: attributes(map[string]any{
+				"service.name":        t.service,
+				"service.instance.id": t.nodeID,
+			})},
+			ScopeSpans: []scopeSpans{{
+				Scope: scope{Name: "github.com/deamondev/gossip-glomers-tutorial/pkg/trace"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+func attributes(m map[string]any) []keyValue {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]keyValue, 0, len(m))
+	for _, k := range keys {
+		var v anyValue
+		switch x := m[k].(type) {
+		case string:
+			v.StringValue = &x
+		case int:
+			s := strconv.Itoa(x)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(x, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &x
+		case bool:
+			v.BoolValue = &x
+		default:
+			s := fmt.Sprint(x)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, keyValue{Key: k, Value: v})
+	}
+
+	return kvs
+}
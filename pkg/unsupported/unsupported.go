@@ -0,0 +1,35 @@
+package unsupported
+
+import (
+	"slices"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Workloads lists the request types of Maelstrom's workloads. Pointed at the
+// wrong binary, a test sends these, and without a handler Node.Run stops at
+// the first one and the node dies.
+var Workloads = []string{
+	"echo",
+	"generate",
+	"broadcast", "read", "topology",
+	"add",
+	"send", "poll", "commit_offsets", "list_committed_offsets",
+	"write", "cas",
+	"txn",
+}
+
+// Attach makes the node answer every workload request type it does not serve
+// with a not-supported error. It must be called before Run, the node's handler
+// table is not safe to change while Run reads it.
+func Attach(n *maelstrom.Node, serves ...string) {
+	for _, typ := range Workloads {
+		if slices.Contains(serves, typ) {
+			continue
+		}
+
+		n.Handle(typ, func(maelstrom.Message) error {
+			return maelstrom.NewRPCError(maelstrom.NotSupported, "unsupported message type: "+typ)
+		})
+	}
+}
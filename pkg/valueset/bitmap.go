@@ -0,0 +1,191 @@
+package valueset
+
+import (
+	"math/bits"
+	"sort"
+)
+
+const (
+	// Containers switch from a sorted array to a bitmap past this cardinality,
+	// that is where the array would take more than the 8KiB a bitmap takes
+	arrayMaxSize = 4096
+	bitmapWords  = (1 << 16) / 64
+
+	// Flipping the sign bit keeps negative values ordered before positive ones
+	signBit = 1 << 63
+)
+
+// BitmapSet is a roaring-style compressed bitmap. Values are split into the
+// high 48 bits, which select a container, and the low 16 bits stored in it.
+// Sparse containers are sorted arrays of uint16, dense ones plain bitmaps, so
+// runs of consecutive values cost about one bit each.
+type BitmapSet struct {
+	keys       []uint64
+	containers []*container
+	count      int
+}
+
+type container struct {
+	array  []uint16
+	bitmap []uint64
+	card   int
+}
+
+func NewBitmapSet() *BitmapSet {
+	return &BitmapSet{}
+}
+
+func split(v int) (uint64, uint16) {
+	u := uint64(v) ^ signBit
+
+	return u >> 16, uint16(u)
+}
+
+func join(high uint64, low uint16) int {
+	return int((high<<16 | uint64(low)) ^ signBit)
+}
+
+func (b *BitmapSet) Add(v int) bool {
+	high, low := split(v)
+
+	i := sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= high })
+	if i == len(b.keys) || b.keys[i] != high {
+		b.keys = append(b.keys, 0)
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = high
+
+		b.containers = append(b.containers, nil)
+		copy(b.containers[i+1:], b.containers[i:])
+		b.containers[i] = &container{}
+	}
+
+	if !b.containers[i].add(low) {
+		return false
+	}
+
+	b.count++
+
+	return true
+}
+
+func (b *BitmapSet) Contains(v int) bool {
+	high, low := split(v)
+
+	i := sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= high })
+	if i == len(b.keys) || b.keys[i] != high {
+		return false
+	}
+
+	return b.containers[i].contains(low)
+}
+
+// Iterate visits values in ascending order
+func (b *BitmapSet) Iterate(fn func(v int) bool) {
+	b.iterateFrom(0, fn)
+}
+
+func (b *BitmapSet) Count() int {
+	return b.count
+}
+
+func (b *BitmapSet) ExportRange(lo, hi int) []int {
+	var values []int
+	if lo >= hi {
+		return values
+	}
+
+	high, _ := split(lo)
+	start := sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= high })
+
+	b.iterateFrom(start, func(v int) bool {
+		if v >= hi {
+			return false
+		}
+		if v >= lo {
+			values = append(values, v)
+		}
+		return true
+	})
+
+	return values
+}
+
+func (b *BitmapSet) iterateFrom(start int, fn func(v int) bool) {
+	for i := start; i < len(b.keys); i++ {
+		high := b.keys[i]
+		if !b.containers[i].iterate(func(low uint16) bool { return fn(join(high, low)) }) {
+			return
+		}
+	}
+}
+
+func (c *container) add(low uint16) bool {
+	if c.bitmap != nil {
+		word, bit := low/64, uint64(1)<<(low%64)
+		if c.bitmap[word]&bit != 0 {
+			return false
+		}
+
+		c.bitmap[word] |= bit
+		c.card++
+
+		return true
+	}
+
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= low })
+	if i < len(c.array) && c.array[i] == low {
+		return false
+	}
+
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = low
+	c.card++
+
+	if c.card > arrayMaxSize {
+		c.toBitmap()
+	}
+
+	return true
+}
+
+func (c *container) contains(low uint16) bool {
+	if c.bitmap != nil {
+		return c.bitmap[low/64]&(uint64(1)<<(low%64)) != 0
+	}
+
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= low })
+
+	return i < len(c.array) && c.array[i] == low
+}
+
+func (c *container) iterate(fn func(low uint16) bool) bool {
+	if c.bitmap == nil {
+		for _, low := range c.array {
+			if !fn(low) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for word, w := range c.bitmap {
+		for w != 0 {
+			bit := bits.TrailingZeros64(w)
+			if !fn(uint16(word*64 + bit)) {
+				return false
+			}
+			w &= w - 1
+		}
+	}
+
+	return true
+}
+
+func (c *container) toBitmap() {
+	c.bitmap = make([]uint64, bitmapWords)
+	for _, low := range c.array {
+		c.bitmap[low/64] |= uint64(1) << (low % 64)
+	}
+	c.array = nil
+}
@@ -0,0 +1,113 @@
+package valueset
+
+import (
+	"fmt"
+	"slices"
+)
+
+const (
+	BackendMap    = "map"
+	BackendBitmap = "bitmap"
+)
+
+// Set stores broadcast values. Implementations are not safe for concurrent
+// use, the servers guard them with their own mutex.
+type Set interface {
+	// Add inserts v and returns false if it was already present
+	Add(v int) bool
+	Contains(v int) bool
+	// Iterate calls fn for every value until fn returns false
+	Iterate(fn func(v int) bool)
+	Count() int
+	// ExportRange returns the sorted values in [lo, hi)
+	ExportRange(lo, hi int) []int
+}
+
+func New(backend string) (Set, error) {
+	switch backend {
+	case "", BackendMap:
+		return NewMapSet(), nil
+	case BackendBitmap:
+		return NewBitmapSet(), nil
+	default:
+		return nil, fmt.Errorf("unknown set backend: %s", backend)
+	}
+}
+
+// Values copies the whole set into a slice
+func Values(s Set) []int {
+	values := make([]int, 0, s.Count())
+	s.Iterate(func(v int) bool {
+		values = append(values, v)
+		return true
+	})
+
+	return values
+}
+
+// MapSet is the plain map[int]struct{} the servers started with. It is fast,
+// but costs tens of bytes per value.
+type MapSet struct {
+	values map[int]struct{}
+}
+
+func NewMapSet() *MapSet {
+	return &MapSet{values: make(map[int]struct{})}
+}
+
+func (m *MapSet) Add(v int) bool {
+	if _, exists := m.values[v]; exists {
+		return false
+	}
+
+	m.values[v] = struct{}{}
+
+	return true
+}
+
+func (m *MapSet) Contains(v int) bool {
+	_, exists := m.values[v]
+
+	return exists
+}
+
+// Iterate visits values in no particular order
+func (m *MapSet) Iterate(fn func(v int) bool) {
+	for v := range m.values {
+		if !fn(v) {
+			return
+		}
+	}
+}
+
+func (m *MapSet) Count() int {
+	return len(m.values)
+}
+
+func (m *MapSet) ExportRange(lo, hi int) []int {
+	var values []int
+	if lo >= hi {
+		return values
+	}
+
+	// A range narrower than the set is cheaper to probe value by value, the
+	// unsigned difference cannot overflow
+	if uint64(hi)-uint64(lo) <= uint64(len(m.values)) {
+		for v := lo; v < hi; v++ {
+			if _, exists := m.values[v]; exists {
+				values = append(values, v)
+			}
+		}
+
+		return values
+	}
+
+	for v := range m.values {
+		if v >= lo && v < hi {
+			values = append(values, v)
+		}
+	}
+	slices.Sort(values)
+
+	return values
+}
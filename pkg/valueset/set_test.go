@@ -0,0 +1,84 @@
+package valueset
+
+import (
+	"runtime"
+	"testing"
+)
+
+// The README's numbers: a million consecutive values, as the broadcast
+// workloads produce them
+const benchmarkValues = 1_000_000
+
+var backends = []struct {
+	name string
+	new  func() Set
+}{
+	{"map", func() Set { return NewMapSet() }},
+	{"bitmap", func() Set { return NewBitmapSet() }},
+}
+
+func filled(newSet func() Set, n int) Set {
+	s := newSet()
+	for v := range n {
+		s.Add(v)
+	}
+
+	return s
+}
+
+func BenchmarkAdd(b *testing.B) {
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			s := backend.new()
+			for i := 0; b.Loop(); i++ {
+				s.Add(i)
+			}
+		})
+	}
+}
+
+// A read copies the whole set into the read_ok reply
+func BenchmarkRead(b *testing.B) {
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			s := filled(backend.new, benchmarkValues)
+			b.ReportAllocs()
+
+			for b.Loop() {
+				if values := Values(s); len(values) != benchmarkValues {
+					b.Fatalf("read %d values, want %d", len(values), benchmarkValues)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMemory reports the live heap a set of a million values keeps, in
+// bytes per set and per value
+func BenchmarkMemory(b *testing.B) {
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			var heap uint64
+			for b.Loop() {
+				before := liveHeap()
+				s := filled(backend.new, benchmarkValues)
+				heap = liveHeap() - before
+				runtime.KeepAlive(s)
+			}
+
+			b.ReportMetric(float64(heap), "bytes/set")
+			b.ReportMetric(float64(heap)/benchmarkValues, "bytes/value")
+		})
+	}
+}
+
+func liveHeap() uint64 {
+	runtime.GC()
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	return stats.HeapAlloc
+}
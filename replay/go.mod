@@ -0,0 +1,3 @@
+module github.com/deamondev/gossip-glomers-tutorial/replay
+
+go 1.25.4
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/replay"
+)
+
+// replay starts a fresh node and feeds it a stream recorded with RECORD_DIR,
+// keeping the original gaps between messages. The node's output goes to our
+// stdout and stderr, the environment (BROADCAST_MODE, ...) is passed through
+// except for recording.
+func main() {
+	log.SetOutput(os.Stderr)
+
+	binary := flag.String("bin", "", "node binary to replay into")
+	file := flag.String("file", "", "recording, <node id>.replay.jsonl")
+	speed := flag.Float64("speed", 1, "playback speed, 0 sends everything at once")
+	linger := flag.Duration("linger", 2*time.Second, "how long to keep the node running after the last message")
+	flag.Parse()
+
+	if *binary == "" || *file == "" {
+		log.Fatal("-bin and -file are required")
+	}
+
+	rec, err := os.Open(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rec.Close()
+
+	cmd := exec.Command(*binary)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// A recording node truncates <node id>.replay.jsonl, which may be the file
+	// we are reading. The empty value also wins over a CONFIG_FILE's record_dir.
+	cmd.Env = append(slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		return strings.HasPrefix(kv, "RECORD_DIR=")
+	}), "RECORD_DIR=")
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		log.Fatal(err)
+	}
+
+	count, err := replay.Play(rec, stdin, *speed)
+	// EPIPE means the node exited early, its own output says why
+	if err != nil && !errors.Is(err, syscall.EPIPE) {
+		log.Printf("Replay stopped: %v", err)
+	}
+	log.Printf("Replayed %d messages, waiting %s before shutting the node down", count, *linger)
+
+	time.Sleep(*linger)
+	stdin.Close()
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			log.Fatalf("Node exited: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		// Handlers waiting on replies that were recorded for an earlier msg_id never return
+		log.Printf("Node did not stop after its input ended, killing it")
+		cmd.Process.Kill()
+		<-exited
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	// Upper bound on IDs per generate_batch, to keep replies reasonably small
+	maxBatchSize = 10000
+
+	// Every node owns its own slice of the range space, so reservations need no
+	// coordination and stay unique under partitions: bits 48-60 hold the node
+	// index, bit 61 is the range tag
+	rangeNodeShift = 48
+	maxRangeNodes  = rangeTag >> rangeNodeShift
+	maxRangeOffset = 1 << rangeNodeShift
+)
+
+type GenerateBatchMessage struct {
+	Type   string `json:"type"`
+	MsgID  int    `json:"msg_id"`
+	Count  int    `json:"count"`
+	Format string `json:"format,omitempty"`
+}
+
+type GenerateBatchMessageResponse struct {
+	Type      string `json:"type"`
+	InReplyTo int    `json:"in_reply_to"`
+	Ids       []any  `json:"ids"`
+}
+
+type ReserveRangeMessage struct {
+	Type  string `json:"type"`
+	MsgID int    `json:"msg_id"`
+	Count uint64 `json:"count"`
+}
+
+type ReserveRangeMessageResponse struct {
+	Type      string `json:"type"`
+	InReplyTo int    `json:"in_reply_to"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+}
+
+func (s *Server) generateBatchHandler(msg maelstrom.Message) error {
+	var body GenerateBatchMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	if body.Count <= 0 || body.Count > maxBatchSize {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("count must be between 1 and %d", maxBatchSize))
+	}
+
+	format := s.format
+	if body.Format != "" {
+		format = body.Format
+	}
+
+	ids := make([]any, 0, body.Count)
+	for range body.Count {
+		id, err := s.generate(format)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	generateBatchMessageResponse := GenerateBatchMessageResponse{
+		Type:      "generate_batch_ok",
+		InReplyTo: body.MsgID,
+		Ids:       ids,
+	}
+
+	return s.node.Send(msg.Src, generateBatchMessageResponse)
+}
+
+func (s *Server) reserveRangeHandler(msg maelstrom.Message) error {
+	var body ReserveRangeMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	if body.Count == 0 {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "count must be positive")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.left {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "node has left the cluster")
+	}
+
+	if s.nodeIndex >= maxRangeNodes {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, fmt.Sprintf("ranges support at most %d nodes", maxRangeNodes))
+	}
+
+	if body.Count > maxRangeOffset-s.rangeOffset {
+		return maelstrom.NewRPCError(maelstrom.Abort, "range space of this node is exhausted")
+	}
+
+	end := s.rangeOffset + body.Count
+	if s.highWater != nil {
+		if err := s.highWater.ReserveRange(end); err != nil {
+			return err
+		}
+	}
+
+	base := rangeTag | int64(s.nodeIndex)<<rangeNodeShift
+	reserveRangeMessageResponse := ReserveRangeMessageResponse{
+		Type:      "reserve_range_ok",
+		InReplyTo: body.MsgID,
+		Start:     base + int64(s.rangeOffset),
+		End:       base + int64(end),
+	}
+
+	s.rangeOffset = end
+
+	return s.node.Send(msg.Src, reserveRangeMessageResponse)
+}
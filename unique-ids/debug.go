@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+type DebugStateMessage struct {
+	Type  string `json:"type"`
+	MsgID int    `json:"msg_id"`
+}
+
+type DebugStateMessageResponse struct {
+	Type        string `json:"type"`
+	InReplyTo   int    `json:"in_reply_to"`
+	NodeID      string `json:"node_id"`
+	Role        string `json:"role"`
+	Format      string `json:"format"`
+	NodeIndex   int    `json:"node_index"`
+	Counter     uint64 `json:"counter"`
+	RangeOffset uint64 `json:"range_offset"`
+	// Only set with DATA_DIR: what a restarted node would resume from
+	HighWaterCounter uint64 `json:"high_water_counter,omitempty"`
+	HighWaterMillis  int64  `json:"high_water_millis,omitempty"`
+	UptimeMs         int64  `json:"uptime_ms"`
+}
+
+func (s *Server) debugStateHandler(msg maelstrom.Message) error {
+	var body DebugStateMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Every node hands out IDs on its own, there is no coordinator
+	debugStateMessageResponse := DebugStateMessageResponse{
+		Type:        "debug_state_ok",
+		InReplyTo:   body.MsgID,
+		NodeID:      s.nodeID,
+		Role:        "PEER",
+		Format:      s.format,
+		NodeIndex:   s.nodeIndex,
+		Counter:     s.counter,
+		RangeOffset: s.rangeOffset,
+		UptimeMs:    time.Since(s.startedAt).Milliseconds(),
+	}
+
+	if s.highWater != nil {
+		debugStateMessageResponse.HighWaterCounter = s.highWater.Counter()
+		debugStateMessageResponse.HighWaterMillis = s.highWater.Millis()
+	}
+
+	// See generateHandler, counters may not fit into a float64
+	return s.node.Send(msg.Src, debugStateMessageResponse)
+}
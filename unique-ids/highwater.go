@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/storage"
+)
+
+const (
+	// How many counter values are reserved with a single write
+	counterBlock = 1000
+	// How far ahead of the clock timestamps are reserved with a single write, in milliseconds
+	millisLease = 1000
+)
+
+// HighWater persists upper bounds on what this node may hand out. A bound is
+// written to disk before any ID beyond the previous one is issued, so after a
+// restart the node skips whatever was left of the previous block and never
+// reissues an ID.
+type HighWater struct {
+	store *storage.Store
+	state highWaterState
+}
+
+type highWaterState struct {
+	Counter uint64 `json:"counter"`
+	Millis  int64  `json:"millis"`
+	Range   uint64 `json:"range"`
+	// The index claimed when joining, 0 until then. Claimed indexes lie above
+	// every index handed out at init, so 0 is never one.
+	NodeIndex int `json:"node_index,omitempty"`
+}
+
+func OpenHighWater(dir string) (*HighWater, error) {
+	store, err := storage.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, _, err := store.Recover()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &HighWater{store: store}
+	if snapshot != nil {
+		if err := json.Unmarshal(snapshot, &h.state); err != nil {
+			return nil, fmt.Errorf("decode high-water marks: %w", err)
+		}
+	}
+
+	log.Printf("Recovered high-water marks, counter: %d, millis: %d, range: %d, node index: %d", h.state.Counter, h.state.Millis, h.state.Range, h.state.NodeIndex)
+
+	return h, nil
+}
+
+// Counter is where the counter should resume after a restart
+func (h *HighWater) Counter() uint64 {
+	return h.state.Counter
+}
+
+// Range is where range reservations should resume after a restart
+func (h *HighWater) Range() uint64 {
+	return h.state.Range
+}
+
+// Millis is where the clocks should resume after a restart
+func (h *HighWater) Millis() int64 {
+	return h.state.Millis
+}
+
+// NodeIndex is the index the node claimed when it joined, if it did
+func (h *HighWater) NodeIndex() (int, bool) {
+	return h.state.NodeIndex, h.state.NodeIndex != 0
+}
+
+// SetNodeIndex keeps a claimed index, IDs issued with it must not come from
+// the init index again after a restart
+func (h *HighWater) SetNodeIndex(index int) error {
+	h.state.NodeIndex = index
+
+	return h.persist()
+}
+
+// ReserveCounter makes sure counter lies below the persisted bound
+func (h *HighWater) ReserveCounter(counter uint64) error {
+	if counter < h.state.Counter {
+		return nil
+	}
+
+	h.state.Counter = counter + counterBlock
+
+	return h.persist()
+}
+
+// ReserveRange makes sure the range ending at end lies below the persisted bound
+func (h *HighWater) ReserveRange(end uint64) error {
+	if end <= h.state.Range {
+		return nil
+	}
+
+	h.state.Range = end + counterBlock
+
+	return h.persist()
+}
+
+// ReserveMillis makes sure millis lies below the persisted bound
+func (h *HighWater) ReserveMillis(millis int64) error {
+	if millis < h.state.Millis {
+		return nil
+	}
+
+	h.state.Millis = millis + millisLease
+
+	return h.persist()
+}
+
+func (h *HighWater) persist() error {
+	buf, err := json.Marshal(h.state)
+	if err != nil {
+		return err
+	}
+
+	return h.store.Snapshot(buf)
+}
+
+func (h *HighWater) Close() error {
+	return h.store.Close()
+}
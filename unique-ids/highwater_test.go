@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/config"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// testServer runs the handlers directly, replies end up in out
+type testServer struct {
+	*Server
+	out   *bytes.Buffer
+	msgID int
+}
+
+// startServer boots a node the way maelstrom would, on an existing data
+// directory. Dropping it without Close stands in for a crash.
+func startServer(t *testing.T, dataDir, format string) *testServer {
+	t.Helper()
+
+	n := maelstrom.NewNode()
+	out := &bytes.Buffer{}
+	n.Stdout = out
+
+	cfg := config.Default()
+	cfg.DataDir = dataDir
+	cfg.IDs.Format = format
+
+	ts := &testServer{Server: NewServer(n, cfg), out: out}
+	ts.call(t, ts.initHandler, map[string]any{"type": "init", "node_id": "n0", "node_ids": []string{"n0", "n1"}})
+
+	return ts
+}
+
+// call hands body to the handler and decodes the reply into a map, numbers
+// stay json.Number so 64-bit IDs keep their low bits
+func (ts *testServer) call(t *testing.T, handler maelstrom.HandlerFunc, body map[string]any) map[string]any {
+	t.Helper()
+
+	ts.msgID++
+	body["msg_id"] = ts.msgID
+	buf, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.out.Reset()
+	if err := handler(maelstrom.Message{Src: "c1", Dest: "n0", Body: buf}); err != nil {
+		t.Fatalf("%s: %v", body["type"], err)
+	}
+
+	var reply map[string]any
+	scanner := bufio.NewScanner(ts.out)
+	for scanner.Scan() {
+		var msg struct {
+			Body json.RawMessage `json:"body"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(msg.Body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return reply
+}
+
+func (ts *testServer) generate(t *testing.T, count int) []string {
+	t.Helper()
+
+	var ids []string
+	for range count {
+		reply := ts.call(t, ts.generateHandler, map[string]any{"type": "generate"})
+		ids = append(ids, fmt.Sprint(reply["id"]))
+	}
+
+	return ids
+}
+
+func TestCrashRestartDoesNotReissueIDs(t *testing.T) {
+	for _, format := range []string{FormatString, FormatSnowflake, FormatULID, FormatUUIDv7} {
+		t.Run(format, func(t *testing.T) {
+			dataDir := t.TempDir()
+
+			before := startServer(t, dataDir, format).generate(t, 50)
+			after := startServer(t, dataDir, format).generate(t, 50)
+
+			seen := make(map[string]bool, len(before))
+			for _, id := range before {
+				seen[id] = true
+			}
+			for _, id := range after {
+				if seen[id] {
+					t.Fatalf("id %s was issued again after the restart", id)
+				}
+			}
+		})
+	}
+}
+
+func TestCrashRestartDoesNotReissueRanges(t *testing.T) {
+	dataDir := t.TempDir()
+
+	reserve := func(ts *testServer) (int64, int64) {
+		reply := ts.call(t, ts.reserveRangeHandler, map[string]any{"type": "reserve_range", "count": 10})
+
+		start, err := reply["start"].(json.Number).Int64()
+		if err != nil {
+			t.Fatal(err)
+		}
+		end, err := reply["end"].(json.Number).Int64()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return start, end
+	}
+
+	// Ranges grow upwards, so the first one after the restart has to start
+	// past the last one before it
+	ts := startServer(t, dataDir, FormatString)
+	reserve(ts)
+	_, end := reserve(ts)
+
+	restarted := startServer(t, dataDir, FormatString)
+	start, _ := reserve(restarted)
+
+	if start < end {
+		t.Fatalf("range starting at %d overlaps the ranges issued before the restart, which end at %d", start, end)
+	}
+}
+
+func TestCrashRestartKeepsClaimedNodeIndex(t *testing.T) {
+	dataDir := t.TempDir()
+
+	// joinHandler persists the index it claimed from lin-kv this way
+	ts := startServer(t, dataDir, FormatSnowflake)
+	if err := ts.highWater.SetNodeIndex(7); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := startServer(t, dataDir, FormatSnowflake)
+	if restarted.nodeIndex != 7 {
+		t.Fatalf("node index after the restart is %d, the node had claimed 7", restarted.nodeIndex)
+	}
+	if restarted.indexFloor <= 7 {
+		t.Fatalf("index floor %d would let another node claim 7", restarted.indexFloor)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	// Next node index that has never been handed out, in lin-kv
+	nodeIndexKey = "unique-ids/next-node-index"
+	// How often claiming an index may lose a compare-and-swap race
+	nodeIndexAttempts = 100
+)
+
+// Sent by an operator to a freshly started node, before any client request
+type JoinMessage struct {
+	Type string `json:"type"`
+	// Member that tells us how many indexes the cluster started with, the
+	// first other node from init when empty
+	Seed string `json:"seed,omitempty"`
+}
+
+type JoinMessageResponse struct {
+	Type      string `json:"type"`
+	NodeIndex int    `json:"node_index"`
+}
+
+type IndexFloorMessage struct {
+	Type string `json:"type"`
+}
+
+type IndexFloorMessageResponse struct {
+	Type  string `json:"type"`
+	Floor int    `json:"floor"`
+}
+
+// Sent by an operator to the node that is decommissioned
+type LeaveMessage struct {
+	Type string `json:"type"`
+}
+
+type LeaveMessageResponse struct {
+	Type string `json:"type"`
+}
+
+// A joining node cannot trust the index from its own init message, another
+// node may already use it. It claims one that was never used instead, and
+// indexes are never reused, so IDs issued by nodes that left stay unique.
+func (s *Server) joinHandler(msg maelstrom.Message) error {
+	var body JoinMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	s.mu.Lock()
+	seed := body.Seed
+	for _, nodeID := range s.nodeIDs {
+		if seed == "" && nodeID != s.nodeID {
+			seed = nodeID
+		}
+	}
+	floor := s.indexFloor
+	s.mu.Unlock()
+
+	if seed == "" {
+		return maelstrom.NewRPCError(maelstrom.PreconditionFailed, "no member to join through")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.RPC.Timeout.Duration())
+	defer cancel()
+
+	resp, err := s.node.SyncRPC(ctx, seed, IndexFloorMessage{Type: "index_floor"})
+	if err != nil {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "seed "+seed+" did not answer: "+err.Error())
+	}
+
+	var indexFloorMessageResponse IndexFloorMessageResponse
+	if err := json.Unmarshal(resp.Body, &indexFloorMessageResponse); err != nil {
+		return err
+	}
+	floor = max(floor, indexFloorMessageResponse.Floor)
+
+	index, err := claimNodeIndex(ctx, maelstrom.NewLinKV(s.node), floor)
+	if err != nil {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "could not claim a node index: "+err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.highWater != nil {
+		if err := s.highWater.SetNodeIndex(index); err != nil {
+			return maelstrom.NewRPCError(maelstrom.Crash, "persist node index: "+err.Error())
+		}
+	}
+
+	// Generators are recreated with the new index on their next use. The range
+	// offset carries on, a fresh index has nothing below it anyway.
+	s.nodeIndex = index
+	s.indexFloor = max(s.indexFloor, index+1)
+	s.snowflake, s.ulid, s.uuidv7 = nil, nil, nil
+
+	log.Printf("Joined the cluster through %s, node index: %d", seed, index)
+
+	joinMessageResponse := JoinMessageResponse{
+		Type:      "join_ok",
+		NodeIndex: index,
+	}
+
+	return s.node.Reply(msg, joinMessageResponse)
+}
+
+func (s *Server) indexFloorHandler(msg maelstrom.Message) error {
+	var body IndexFloorMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indexFloorMessageResponse := IndexFloorMessageResponse{
+		Type:  "index_floor_ok",
+		Floor: s.indexFloor,
+	}
+
+	return s.node.Reply(msg, indexFloorMessageResponse)
+}
+
+// There is nothing to hand off, every ID is final once it is returned. The
+// index is retired with the node.
+func (s *Server) leaveHandler(msg maelstrom.Message) error {
+	var body LeaveMessage
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.left = true
+	log.Printf("Left the cluster, retiring node index %d", s.nodeIndex)
+
+	leaveMessageResponse := LeaveMessageResponse{
+		Type: "leave_ok",
+	}
+
+	return s.node.Reply(msg, leaveMessageResponse)
+}
+
+// claimNodeIndex takes the next never used index, at least floor, from a
+// counter in lin-kv
+func claimNodeIndex(ctx context.Context, kv *maelstrom.KV, floor int) (int, error) {
+	for range nodeIndexAttempts {
+		current, err := kv.ReadInt(ctx, nodeIndexKey)
+		var rpcErr *maelstrom.RPCError
+		if errors.As(err, &rpcErr) && rpcErr.Code == maelstrom.KeyDoesNotExist {
+			current, err = floor, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		index := max(current, floor)
+		err = kv.CompareAndSwap(ctx, nodeIndexKey, current, index+1, true)
+		if err == nil {
+			return index, nil
+		}
+
+		// Another node joined at the same time, try again with the fresh value
+		if errors.As(err, &rpcErr) && rpcErr.Code == maelstrom.PreconditionFailed {
+			continue
+		}
+
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("lost %d compare-and-swap races for a node index", nodeIndexAttempts)
+}
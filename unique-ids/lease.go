@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	leaseKey = "id-counter"
+	// How many IDs a single CAS on lin-kv hands to a node
+	leaseBlock = 100
+	// Attempts to win the CAS race against other nodes before giving up
+	leaseAttempts = 10
+)
+
+// LeaseAllocator hands out dense numeric IDs. Blocks of leaseBlock IDs are
+// leased from a shared counter in lin-kv, and the next block is fetched in the
+// background once half of the current one is used. While lin-kv is unavailable
+// the node keeps serving whatever is left of its leases.
+type LeaseAllocator struct {
+	kv      *maelstrom.KV
+	timeout time.Duration
+
+	mu        sync.Mutex
+	next, end uint64
+	spare     [2]uint64
+	hasSpare  bool
+	refilling bool
+}
+
+func NewLeaseAllocator(kv *maelstrom.KV, timeout time.Duration) *LeaseAllocator {
+	return &LeaseAllocator{kv: kv, timeout: timeout}
+}
+
+func (a *LeaseAllocator) Next(ctx context.Context) (uint64, error) {
+	a.mu.Lock()
+	if a.next == a.end && a.hasSpare {
+		a.next, a.end = a.spare[0], a.spare[1]
+		a.hasSpare = false
+	}
+
+	if a.next < a.end {
+		id := a.next
+		a.next++
+
+		if a.end-a.next < leaseBlock/2 && !a.hasSpare && !a.refilling {
+			a.refilling = true
+			go a.refill()
+		}
+
+		a.mu.Unlock()
+		return id, nil
+	}
+	a.mu.Unlock()
+
+	// Nothing left locally, we have to wait for lin-kv
+	start, end, err := a.acquire(ctx)
+	if err != nil {
+		return 0, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "no leased ids left and lin-kv is unavailable: "+err.Error())
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// A concurrent caller may have installed a lease meanwhile, keep ours as the spare
+	if a.next < a.end {
+		a.spare = [2]uint64{start + 1, end}
+		a.hasSpare = true
+	} else {
+		a.next, a.end = start+1, end
+	}
+
+	return start, nil
+}
+
+func (a *LeaseAllocator) refill() {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	start, end, err := a.acquire(ctx)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.refilling = false
+	if err != nil {
+		log.Printf("Failed to lease ids from lin-kv, serving local remainder: %v", err)
+		return
+	}
+
+	a.spare = [2]uint64{start, end}
+	a.hasSpare = true
+}
+
+// acquire moves the shared counter forward by a block with compare-and-swap
+func (a *LeaseAllocator) acquire(ctx context.Context) (uint64, uint64, error) {
+	for range leaseAttempts {
+		current, err := a.kv.ReadInt(ctx, leaseKey)
+		var rpcErr *maelstrom.RPCError
+		if errors.As(err, &rpcErr) && rpcErr.Code == maelstrom.KeyDoesNotExist {
+			current, err = 0, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		// Above this the IDs would run into the range and snowflake tags
+		if current+leaseBlock > maxLeaseID {
+			return 0, 0, errors.New("lease counter is exhausted")
+		}
+
+		err = a.kv.CompareAndSwap(ctx, leaseKey, current, current+leaseBlock, true)
+		if err == nil {
+			log.Printf("Leased ids [%d, %d)", current, current+leaseBlock)
+			return uint64(current), uint64(current + leaseBlock), nil
+		}
+
+		// Another node won the race, try again with the fresh value
+		if errors.As(err, &rpcErr) && rpcErr.Code == maelstrom.PreconditionFailed {
+			continue
+		}
+
+		return 0, 0, err
+	}
+
+	return 0, 0, errors.New("lost too many compare-and-swap races")
+}
@@ -4,15 +4,46 @@ import (
 	"log"
 	"os"
 
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/config"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/history"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/replay"
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/unsupported"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
 func main() {
 	log.SetOutput(os.Stderr)
 
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	n := maelstrom.NewNode()
 
-	s := NewServer(n)
+	// Answer the requests of other workloads instead of dying on them
+	unsupported.Attach(n, "generate")
+
+	// Record client operations for offline checking
+	if cfg.HistoryDir != "" {
+		recorder, err := history.Attach(n, cfg.HistoryDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer recorder.Close()
+	}
+
+	// Keep every inbound message so a failed run can be replayed on a single node
+	if cfg.RecordDir != "" {
+		recorder, err := replay.Attach(n, cfg.RecordDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer recorder.Close()
+	}
+
+	s := NewServer(n, cfg)
+	defer s.Close()
 
 	if err := s.Run(); err != nil {
 		log.Fatal(err)
@@ -1,35 +1,90 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/deamondev/gossip-glomers-tutorial/pkg/config"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
+const (
+	// "<node id>-<counter>" strings
+	FormatString = "string"
+	// Time-ordered 64-bit integers
+	FormatSnowflake = "snowflake"
+	// 26 character Crockford base32 strings
+	FormatULID = "ulid"
+	// RFC 9562 version 7 UUIDs
+	FormatUUIDv7 = "uuidv7"
+	// Dense integers leased in blocks from a counter in lin-kv
+	FormatLease = "lease"
+)
+
+// Integer IDs carry their format in the top bits of a positive int64, so
+// snowflakes, reserved ranges and leased IDs never collide: 1x for snowflakes,
+// 01 for ranges and 00 for leases
+const (
+	snowflakeTag = 1 << 62
+	rangeTag     = 1 << 61
+	maxLeaseID   = 1 << 61
+)
+
 type Server struct {
-	node    *maelstrom.Node
-	nodeID  string
-	mu      sync.Mutex
-	counter uint64
+	node      *maelstrom.Node
+	nodeID    string
+	startedAt time.Time
+	cfg       config.Config
+	mu        sync.Mutex
+	counter   uint64
+
+	// Next free offset in this node's slice of the range space
+	rangeOffset uint64
+
+	format    string
+	nodeIDs   []string
+	nodeIndex int
+	snowflake *Snowflake
+	ulid      *ULIDGenerator
+	uuidv7    *UUIDv7Generator
+	lease     *LeaseAllocator
+
+	// Lowest index nobody in the cluster can be using yet, as far as we know
+	indexFloor int
+	left       bool
+
+	highWater *HighWater
 }
 
 type GenerateMessage struct {
-	Type string `json:"type"`
+	Type  string `json:"type"`
+	MsgID int    `json:"msg_id"`
+	// Optional, overrides the format the server was started with
+	Format string `json:"format,omitempty"`
 }
 
 type GenerateMessageResponse struct {
-	Type string `json:"type"`
-	Id   string `json:"id"`
+	Type      string `json:"type"`
+	InReplyTo int    `json:"in_reply_to"`
+	Id        any    `json:"id"`
 }
 
-func NewServer(n *maelstrom.Node) *Server {
-	s := &Server{node: n, counter: 0}
+func NewServer(n *maelstrom.Node, cfg config.Config) *Server {
+	s := &Server{node: n, startedAt: time.Now(), cfg: cfg, counter: 0, format: cfg.IDs.Format}
 
 	s.node.Handle("init", s.initHandler)
 	s.node.Handle("generate", s.generateHandler)
+	s.node.Handle("generate_batch", s.generateBatchHandler)
+	s.node.Handle("reserve_range", s.reserveRangeHandler)
+	s.node.Handle("debug_state", s.debugStateHandler)
+	s.node.Handle("join", s.joinHandler)
+	s.node.Handle("index_floor", s.indexFloorHandler)
+	s.node.Handle("leave", s.leaveHandler)
 
 	return s
 }
@@ -37,37 +92,169 @@ func NewServer(n *maelstrom.Node) *Server {
 func (s *Server) initHandler(msg maelstrom.Message) error {
 	var body maelstrom.InitMessageBody
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
-		return err
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.nodeID = body.NodeID
 
 	log.Printf("Node id set to: %s", s.nodeID)
 
+	index, err := nodeIndex(body.NodeID, body.NodeIDs)
+	if err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+	s.nodeIndex = index
+	s.nodeIDs = body.NodeIDs
+	s.indexFloor = len(body.NodeIDs)
+
+	if s.cfg.DataDir != "" {
+		highWater, err := OpenHighWater(filepath.Join(s.cfg.DataDir, s.nodeID))
+		if err != nil {
+			return maelstrom.NewRPCError(maelstrom.Crash, "open high-water marks: "+err.Error())
+		}
+
+		s.highWater = highWater
+		s.counter = highWater.Counter()
+		s.rangeOffset = highWater.Range()
+
+		// A node that joined before the restart keeps the index it claimed
+		if index, ok := highWater.NodeIndex(); ok {
+			log.Printf("Resuming with claimed node index: %d", index)
+			s.nodeIndex = index
+			s.indexFloor = max(s.indexFloor, index+1)
+		}
+	}
+
 	return nil
 }
 
 func (s *Server) generateHandler(msg maelstrom.Message) error {
 	var body GenerateMessage
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	format := s.format
+	if body.Format != "" {
+		format = body.Format
+	}
+
+	id, err := s.generate(format)
+	if err != nil {
 		return err
 	}
 
+	generateMessageResponse := GenerateMessageResponse{
+		Type:      "generate_ok",
+		InReplyTo: body.MsgID,
+		Id:        id,
+	}
+
+	// node.Reply round-trips the body through map[string]any, which would turn
+	// 64-bit IDs into float64 and lose their low bits
+	return s.node.Send(msg.Src, generateMessageResponse)
+}
+
+// generate hands out a single ID. A lease may have to wait for lin-kv, so it
+// is taken without s.mu held, the other formats are served under it.
+func (s *Server) generate(format string) (any, error) {
+	if format != FormatLease {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		return s.generateLocked(format)
+	}
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.left {
+		s.mu.Unlock()
+		return nil, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "node has left the cluster")
+	}
+	if s.lease == nil {
+		s.lease = NewLeaseAllocator(maelstrom.NewLinKV(s.node), s.cfg.RPC.Timeout.Duration())
+	}
+	lease := s.lease
+	s.mu.Unlock()
 
-	id := fmt.Sprintf("%s-%d", s.nodeID, s.counter)
-	generateMessageResponse := GenerateMessageResponse{
-		Type: "generate_ok",
-		Id:   id,
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.RPC.Timeout.Duration())
+	defer cancel()
+
+	return lease.Next(ctx)
+}
+
+// Generators are created on first use, so that a format limited to fewer
+// nodes than the cluster has only fails when it is actually requested.
+// Must be called with s.mu held.
+func (s *Server) generateLocked(format string) (any, error) {
+	var err error
+
+	if s.left {
+		return nil, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "node has left the cluster")
 	}
 
-	s.counter++
-	log.Printf("Internal node counter incremented, current value: %d", s.counter)
+	switch format {
+	case FormatString:
+		if s.highWater != nil {
+			if err := s.highWater.ReserveCounter(s.counter); err != nil {
+				return nil, err
+			}
+		}
 
-	return s.node.Reply(msg, generateMessageResponse)
+		id := fmt.Sprintf("%s-%d", s.nodeID, s.counter)
+		s.counter++
+		log.Printf("Internal node counter incremented, current value: %d", s.counter)
+		return id, nil
+	case FormatSnowflake:
+		if s.snowflake == nil {
+			if s.snowflake, err = NewSnowflake(s.nodeIndex, s.newClock(maxSequence)); err != nil {
+				return nil, maelstrom.NewRPCError(maelstrom.NotSupported, err.Error())
+			}
+		}
+		return s.snowflake.Next(time.Now())
+	case FormatULID:
+		if s.ulid == nil {
+			if s.ulid, err = NewULIDGenerator(s.nodeIndex, s.newClock(^uint64(0)-1)); err != nil {
+				return nil, maelstrom.NewRPCError(maelstrom.NotSupported, err.Error())
+			}
+		}
+		return s.ulid.Next(time.Now())
+	case FormatUUIDv7:
+		if s.uuidv7 == nil {
+			if s.uuidv7, err = NewUUIDv7Generator(s.nodeIndex, s.newClock(1<<62-1)); err != nil {
+				return nil, maelstrom.NewRPCError(maelstrom.NotSupported, err.Error())
+			}
+		}
+		return s.uuidv7.Next(time.Now())
+	default:
+		return nil, maelstrom.NewRPCError(maelstrom.NotSupported, "unknown id format: "+format)
+	}
+}
+
+// newClock resumes past the persisted high-water mark, if there is one
+func (s *Server) newClock(maxSequence uint64) *monotonicClock {
+	if s.highWater == nil {
+		return newMonotonicClock(maxSequence, -1, nil)
+	}
+
+	return newMonotonicClock(maxSequence, s.highWater.Millis(), s.highWater.ReserveMillis)
 }
 
 func (s *Server) Run() error {
 	return s.node.Run()
 }
+
+func (s *Server) Close() {
+	log.Printf("Closing server")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.highWater != nil {
+		if err := s.highWater.Close(); err != nil {
+			log.Printf("Failed to close high-water marks: %v", err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	millisBits   = 40
+	nodeBits     = 10
+	sequenceBits = 12
+
+	maxNodes    = 1 << nodeBits
+	maxSequence = 1<<sequenceBits - 1
+)
+
+// Custom epoch, 40 bits of milliseconds since then last until 2058
+var snowflakeEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Snowflake builds sortable 64-bit IDs: the snowflake tag, 40 bits of
+// milliseconds since the epoch, 10 bits of node index and 12 bits of
+// per-millisecond sequence.
+type Snowflake struct {
+	nodeIndex int64
+	clock     *monotonicClock
+}
+
+func NewSnowflake(nodeIndex int, clock *monotonicClock) (*Snowflake, error) {
+	if nodeIndex >= maxNodes {
+		return nil, fmt.Errorf("snowflake IDs support at most %d nodes", maxNodes)
+	}
+
+	return &Snowflake{nodeIndex: int64(nodeIndex), clock: clock}, nil
+}
+
+func (sf *Snowflake) Next(now time.Time) (int64, error) {
+	millis, sequence, err := sf.clock.next(now.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+
+	millis -= snowflakeEpoch.UnixMilli()
+	if millis < 0 || millis >= 1<<millisBits {
+		return 0, fmt.Errorf("time %d is outside of the snowflake epoch", now.UnixMilli())
+	}
+
+	return snowflakeTag | millis<<(nodeBits+sequenceBits) | sf.nodeIndex<<sequenceBits | int64(sequence), nil
+}
+
+// monotonicClock hands out (unix millisecond, sequence) pairs that never
+// repeat and never go backwards
+type monotonicClock struct {
+	maxSequence uint64
+	// Called before a timestamp is used, to persist it as a high-water mark
+	reserve func(millis int64) error
+
+	lastMillis int64
+	lastClock  int64
+	sequence   uint64
+}
+
+// newMonotonicClock starts the clock at floor, which the previous run of the
+// node never reached. Nothing below it will be handed out.
+func newMonotonicClock(maxSequence uint64, floor int64, reserve func(int64) error) *monotonicClock {
+	return &monotonicClock{maxSequence: maxSequence, reserve: reserve, lastMillis: floor, lastClock: -1}
+}
+
+func (c *monotonicClock) next(millis int64) (int64, uint64, error) {
+	if millis < c.lastClock {
+		log.Printf("Clock moved backwards by %dms, holding timestamp", c.lastClock-millis)
+	}
+	c.lastClock = millis
+
+	// Never go below the last timestamp used, whether the clock went backwards
+	// (NTP adjustment, VM migration...) or we borrowed a millisecond on overflow
+	millis = max(millis, c.lastMillis)
+
+	if millis == c.lastMillis {
+		c.sequence++
+		// Sequence exhausted within this millisecond, borrow the next one
+		if c.sequence > c.maxSequence {
+			millis++
+			c.sequence = 0
+		}
+	} else {
+		c.sequence = 0
+	}
+
+	if c.reserve != nil {
+		if err := c.reserve(millis); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	c.lastMillis = millis
+
+	return millis, c.sequence, nil
+}
+
+// nodeIndex is the node's position in the cluster, the init message lists
+// nodes in the same order on every node
+func nodeIndex(nodeID string, nodeIDs []string) (int, error) {
+	for i, id := range nodeIDs {
+		if id == nodeID {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("node %s is not part of the cluster %v", nodeID, nodeIDs)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDGenerator fills the 80 random bits of a ULID with 16 bits of node index
+// and a 64-bit sequence instead, so IDs are unique without coordination
+type ULIDGenerator struct {
+	nodeIndex uint64
+	clock     *monotonicClock
+}
+
+func NewULIDGenerator(nodeIndex int, clock *monotonicClock) (*ULIDGenerator, error) {
+	if nodeIndex >= 1<<16 {
+		return nil, fmt.Errorf("ULIDs support at most %d nodes", 1<<16)
+	}
+
+	return &ULIDGenerator{nodeIndex: uint64(nodeIndex), clock: clock}, nil
+}
+
+func (g *ULIDGenerator) Next(now time.Time) (string, error) {
+	millis, sequence, err := g.clock.next(now.UnixMilli())
+	if err != nil {
+		return "", err
+	}
+
+	// 48 bits of timestamp | 16 bits of node index | 64 bits of sequence
+	hi := uint64(millis)<<16 | g.nodeIndex
+	lo := sequence
+
+	// 128 bits in 26 base32 characters, the first one only carries 3 bits
+	var buf [26]byte
+	for i := len(buf) - 1; i >= 0; i-- {
+		buf[i] = crockfordAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(buf[:]), nil
+}
+
+// UUIDv7Generator uses the 12 bits of rand_a for the node index and the 62
+// bits of rand_b for a sequence (RFC 9562, section 6.2)
+type UUIDv7Generator struct {
+	nodeIndex uint64
+	clock     *monotonicClock
+}
+
+func NewUUIDv7Generator(nodeIndex int, clock *monotonicClock) (*UUIDv7Generator, error) {
+	if nodeIndex >= 1<<12 {
+		return nil, fmt.Errorf("UUIDv7s support at most %d nodes", 1<<12)
+	}
+
+	return &UUIDv7Generator{nodeIndex: uint64(nodeIndex), clock: clock}, nil
+}
+
+func (g *UUIDv7Generator) Next(now time.Time) (string, error) {
+	millis, sequence, err := g.clock.next(now.UnixMilli())
+	if err != nil {
+		return "", err
+	}
+
+	// unix_ts_ms (48) | ver (4) | rand_a (12)
+	hi := uint64(millis)<<16 | 0x7<<12 | g.nodeIndex
+	// var (2) | rand_b (62)
+	lo := uint64(0b10)<<62 | sequence
+
+	var b [16]byte
+	for i := 0; i < 8; i++ {
+		b[i] = byte(hi >> (56 - 8*i))
+		b[8+i] = byte(lo >> (56 - 8*i))
+	}
+
+	h := hex.EncodeToString(b[:])
+
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32], nil
+}